@@ -15,9 +15,7 @@ import (
 )
 
 func newPop3Server(opts ...net.ServerOpt) *pop3S {
-	s := &pop3S{
-		sessions: make(map[api.Response]*pop3Session),
-	}
+	s := &pop3S{}
 
 	s.onAuthenticate = s.defaultAuthenticate
 	s.knownCommands = map[string]pop3Handler{
@@ -54,7 +52,6 @@ func newPop3Server(opts ...net.ServerOpt) *pop3S {
 
 type pop3S struct {
 	net.Server
-	sessions       map[api.Response]*pop3Session
 	knownCommands  map[string]pop3Handler
 	onAuthenticate AuthenticateHandler
 	closed         int32
@@ -94,17 +91,12 @@ type msgS struct {
 	cap int
 }
 
-// Close cleanup itself, includes internal net connections, sessions, ...
+// Close cleanup itself, includes internal net connections. The
+// sessions are dropped with their connections.
 func (s *pop3S) Close() {
 	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
-		for w, sess := range s.sessions {
-			w.Close()
-			sess.Close()
-		}
-		s.sessions = nil
-
+		s.Server.Close()
 	}
-	s.Server.Close()
 }
 
 func (s *pop3S) defaultAuthenticate(sess *pop3Session, user, pass string) (passed bool) {
@@ -121,9 +113,13 @@ func (s *pop3S) defaultAuthenticate(sess *pop3Session, user, pass string) (passe
 	return
 }
 
+// pop3SessionKey keeps the pop3Session in the connection session.
+var pop3SessionKey = net.NewSessionKey[*pop3Session]("pop3")
+
 func (s *pop3S) newSession(w api.Response) (p *pop3Session) {
+	sess := net.SessionOf(w)
 	var ok bool
-	if p, ok = s.sessions[w]; ok {
+	if p, ok = pop3SessionKey.Get(sess); ok {
 		return
 	}
 
@@ -141,12 +137,12 @@ func (s *pop3S) newSession(w api.Response) (p *pop3Session) {
 		},
 	}
 
-	s.sessions[w] = p
+	pop3SessionKey.Set(sess, p)
 	return p
 }
 
 func (s *pop3S) handleData(data []byte, w api.Response, r api.Request) (nn int, err error) {
-	if sess, ok := s.sessions[w]; ok {
+	if sess, ok := pop3SessionKey.Get(net.SessionOf(w)); ok {
 		nn, err = sess.handleData(data, w, r)
 	}
 	return
@@ -170,9 +166,13 @@ func (s *pop3Session) handleData(data []byte, w api.Response, r api.Request) (nn
 
 func (s *pop3Session) dispatchCmd(cmd string, w api.Response) (n int) {
 	println(" [pop3Session] dispatchCmd:", "cmd", cmd)
-	if h, ok := s.server.knownCommands[cmd[:4]]; ok {
-		n = h(s, []byte(cmd[4:]), w)
+	if len(cmd) >= 4 {
+		if h, ok := s.server.knownCommands[cmd[:4]]; ok {
+			n = h(s, []byte(cmd[4:]), w)
+			return
+		}
 	}
+	s.server.Send(s, "-ERR unknown command\r\n")
 	return
 }
 
@@ -182,7 +182,8 @@ func (s *pop3S) handleUser(sess *pop3Session, data []byte, w api.Response) (ate
 	pos := skipws(data, 0)
 	sess.username, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: data-len=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 	s.Send(sess, fmt.Sprintf("+OK hello %s!\r\n", sess.username))
 	return
@@ -194,7 +195,8 @@ func (s *pop3S) handlePass(sess *pop3Session, data []byte, w api.Response) (ate
 	pos := skipws(data, 0)
 	sess.password, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 	if sess.server.onAuthenticate(sess, sess.username, sess.password) {
 		s.Send(sess, fmt.Sprintf("+OK %d message(s) [%d byte(s)]\r\n", len(sess.mailboxes["user"].messages), sess.mailboxes["user"].totalCapacity))
@@ -211,7 +213,8 @@ func (s *pop3S) handleApop(sess *pop3Session, data []byte, w api.Response) (ate
 	sess.digestName, pos = tillChars(data, pos, ',')
 	sess.digest, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 	s.SendOK(sess)
 	return
@@ -223,7 +226,8 @@ func (s *pop3S) handleStat(sess *pop3Session, data []byte, w api.Response) (ate
 	pos := skipws(data, 0)
 	_, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 	s.SendOK(sess)
 	return
@@ -236,7 +240,8 @@ func (s *pop3S) handleUidl(sess *pop3Session, data []byte, w api.Response) (ate
 	var msgn string
 	msgn, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 	if num, err := strconv.Atoi(msgn); err != nil {
 		logz.Error("cannot parse number of message", "err", err, "data", string(data))
@@ -254,7 +259,8 @@ func (s *pop3S) handleList(sess *pop3Session, data []byte, w api.Response) (ate
 	var msgn string
 	msgn, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 	if num, err := strconv.Atoi(msgn); err != nil {
 		logz.Error("cannot parse number of message", "err", err, "data", string(data))
@@ -275,13 +281,14 @@ func (s *pop3S) handleRetr(sess *pop3Session, data []byte, w api.Response) (ate
 	var msgn string
 	msgn, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 	if num, err := strconv.Atoi(msgn); err != nil {
 		logz.Error("cannot parse number of message", "err", err, "data", string(data))
 	} else {
 		logz.Debug("list msg#=<num>", "num", num)
-		if num < len(sess.mailboxes["user"].messages) {
+		if num >= 0 && num < len(sess.mailboxes["user"].messages) {
 			s.Send(sess, fmt.Sprintf("+OK %d octets\r\n", sess.mailboxes["user"].messages[num].cap))
 		} else {
 			s.Send(sess, "-ERR unknown error\r\n")
@@ -297,7 +304,8 @@ func (s *pop3S) handleDele(sess *pop3Session, data []byte, w api.Response) (ate
 	var msgn string
 	msgn, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 	if num, err := strconv.Atoi(msgn); err != nil {
 		logz.Error("cannot parse number of message", "err", err, "data", string(data))
@@ -314,7 +322,8 @@ func (s *pop3S) handleRest(sess *pop3Session, data []byte, w api.Response) (ate
 	pos := skipws(data, 0)
 	_, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 	s.SendOK(sess)
 	sess.lastBeat = time.Now().UTC()
@@ -332,7 +341,8 @@ func (s *pop3S) handleTop(sess *pop3Session, data []byte, w api.Response) (ate i
 	var msgn2 string
 	msgn2, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 
 	var num1, num2 int
@@ -358,7 +368,8 @@ func (s *pop3S) handleNoop(sess *pop3Session, data []byte, w api.Response) (ate
 	pos := skipws(data, 0)
 	_, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 	sess.lastBeat = time.Now().UTC()
 	s.SendOK(sess)
@@ -371,13 +382,12 @@ func (s *pop3S) handleQuit(sess *pop3Session, data []byte, w api.Response) (ate
 	pos := skipws(data, 0)
 	_, pos = tillcr(data, pos)
 	if pos != ate {
-		panic(fmt.Sprintf("wrong command length: ate=%d, parsed-pos=%d, data=%v", ate, pos, string(data)))
+		s.sendSyntaxError(sess, data, pos)
+		return
 	}
 
 	println("[pop3S] Quiting...")
 	time.Sleep(1 * time.Second)
-	sess.Close()
-	delete(s.sessions, w)
 	w.Close()
 
 	return
@@ -389,6 +399,12 @@ func (s *pop3S) Send(sess *pop3Session, msg string) {
 	}
 }
 
+// sendSyntaxError replies a malformed command, instead of panicking.
+func (s *pop3S) sendSyntaxError(sess *pop3Session, data []byte, pos int) {
+	logz.Warn("wrong command length", "data-len", len(data), "parsed-pos", pos, "data", string(data))
+	s.Send(sess, "-ERR wrong command syntax\r\n")
+}
+
 func (s *pop3S) SendOK(sess *pop3Session) {
 	s.Send(sess, fmt.Sprintf("+OK %d %d\r\n", len(sess.mailboxes["user"].messages), sess.mailboxes["user"].totalCapacity))
 }
@@ -2,7 +2,10 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"os"
 	"time"
 
 	"github.com/hedzr/is/basics"
@@ -13,6 +16,8 @@ type Conn interface {
 
 	Response
 	RawWriteable
+	PeerCredentials
+	HalfCloser
 
 	// io.Reader
 }
@@ -44,9 +49,153 @@ type Addressable interface {
 // Writeable provides cacheable writing feature
 type Writeable interface {
 	// Write writes a raw buffer back to the client.
+	//
+	// data is copied into the writing queue, so the caller can
+	// reuse it once Write returned.
 	Write(data []byte) (n int, err error)
 }
 
+// AsyncWriteable provides cacheable writing feature with a
+// notification once the message was sent to the socket or failed.
+type AsyncWriteable interface {
+	// WriteAsync puts data into the writing queue and returns a
+	// handle resolved after data was sent or failed.
+	//
+	// ctx is used while waiting for room in the writing queue.
+	WriteAsync(ctx context.Context, data []byte) WriteCompletion
+	// WriteWithCallback puts data into the writing queue, and cb
+	// will be called after data was sent or failed.
+	//
+	// cb is called by the writing loop, it must not block.
+	WriteWithCallback(ctx context.Context, data []byte, cb func(n int, err error))
+}
+
+// WriteCompletion is the handle of a cached writing, it is resolved
+// after the message was sent to the socket or failed.
+type WriteCompletion interface {
+	// Done is closed after the writing was resolved.
+	Done() <-chan struct{}
+	// Result returns the bytes written and the failure reason. It is
+	// valid only after Done closed.
+	Result() (n int, err error)
+	// Wait blocks till the writing resolved or ctx done.
+	Wait(ctx context.Context) (n int, err error)
+}
+
+// WriteQueueInspector exposes the state of the cached writing
+// queue of a connection.
+type WriteQueueInspector interface {
+	// WriteQueueLen returns how many messages are waiting to be sent.
+	WriteQueueLen() int
+	// WriteQueueCap returns the capacity of the writing queue.
+	WriteQueueCap() int
+	// WriteQueueDropped returns how many messages were discarded
+	// because the queue was full.
+	WriteQueueDropped() int64
+}
+
+// ErrWriteQueueFull is returned by a cached Write if the writing
+// queue is full and the policy refuses to wait.
+var ErrWriteQueueFull = errors.New("write queue full")
+
+// Hijacker lets the caller take over the underlying connection, to
+// switch to another protocol after a handshake, such as STARTTLS.
+type Hijacker interface {
+	// Hijack stops the internal reading and writing loops cleanly,
+	// and returns the underlying connection with the bytes read but
+	// not processed yet. The caller is responsible for closing conn.
+	//
+	// When Hijack is called while processing the incoming data, such
+	// as in OnProcessData, the data being processed includes all
+	// bytes read, so buffered is empty.
+	Hijack() (conn net.Conn, buffered []byte, err error)
+}
+
+// ErrHijacked is returned when a connection has been hijacked.
+var ErrHijacked = errors.New("connection hijacked")
+
+// TLSUpgrader upgrades a plain connection to TLS in-band, as the
+// STARTTLS command of SMTP, POP3 and IMAP.
+type TLSUpgrader interface {
+	// StartTLS pauses the reading, flushes the cached messages,
+	// performs the TLS handshake over the existing connection, and
+	// resumes the reading and writing loops on the TLS stream. The
+	// interceptors and the data processor are kept.
+	//
+	// It should be called while processing the command, such as in
+	// OnProcessData after the positive reply was written, and the
+	// processor should consume the rest of the plain data. The
+	// connection is closed if the handshake failed.
+	StartTLS(ctx context.Context, config *tls.Config) (err error)
+}
+
+// PeerCred is the credentials of the process at the other end of a
+// unix domain socket, as SO_PEERCRED tells.
+type PeerCred struct {
+	PID int
+	UID int
+	GID int
+}
+
+// PeerCredentials provides the credentials of the peer process.
+type PeerCredentials interface {
+	// PeerCred returns the credentials of the peer process of a unix
+	// domain socket connection, on Linux. It returns
+	// ErrPeerCredUnsupported for the other connections.
+	PeerCred() (cred PeerCred, err error)
+}
+
+// ErrPeerCredUnsupported is returned by PeerCred if the connection
+// cannot tell the credentials of its peer.
+var ErrPeerCredUnsupported = errors.New("peer credentials unsupported")
+
+// FilePasser passes the open files over a unix domain socket, as
+// SCM_RIGHTS.
+type FilePasser interface {
+	// SendFiles writes data together with files, after the cached
+	// messages written. data cannot be empty, the files arrive with
+	// its first byte. The caller still owns files.
+	SendFiles(ctx context.Context, data []byte, files ...*os.File) (err error)
+	// ReceivedFiles returns the files received till now, and forgets
+	// them. They come with the data being processed or before it, and
+	// the caller should close them. The files not taken are closed
+	// with the connection.
+	ReceivedFiles() []*os.File
+}
+
+// ErrFilePassingUnsupported is returned by SendFiles if the
+// connection cannot pass the files.
+var ErrFilePassingUnsupported = errors.New("file passing unsupported")
+
+// ErrFilesTruncated is returned by the reading of a connection if
+// more files were passed with a message than the limit, such as
+// WithServerPassFiles. The files over the limit are closed by the
+// system.
+var ErrFilesTruncated = errors.New("passed files truncated")
+
+// HalfCloser shuts down one direction of a stream connection, such
+// as tcp or unix.
+//
+// A server connection is closed after the client finished sending
+// and the data received was processed and replied, unless CloseRead
+// was called.
+type HalfCloser interface {
+	// CloseWrite writes the cached messages, and shuts down the
+	// writing side, so that the peer reads EOF. The reading goes on,
+	// and the later writes fail with ErrWriteClosed.
+	CloseWrite() error
+	// CloseRead shuts down the reading side. The writing goes on till
+	// CloseWrite or Close.
+	CloseRead() error
+}
+
+// ErrWriteClosed is returned by the writing after CloseWrite.
+var ErrWriteClosed = errors.New("write side closed")
+
+// ErrHalfCloseUnsupported is returned by CloseWrite and CloseRead if
+// the connection cannot be half-closed.
+var ErrHalfCloseUnsupported = errors.New("half-close unsupported")
+
 // RawWriteable provides instance writing feature without cache.
 type RawWriteable interface {
 	// RawWrite does write through the internal net.Conn
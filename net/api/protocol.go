@@ -11,6 +11,13 @@ type Codec interface {
 
 type Interceptor interface {
 	// OnReading handles reading event for tcp mode.
+	//
+	// data is the reading buffer owned by the reading loop, do not
+	// retain it after OnReading returned. Copy it, or clone it with
+	// bufpool.Clone, if you need to keep it.
+	//
+	// ctx is the per-connection context, net.ConnFromContext and
+	// net.LoggerFromContext retrieve the connection and its logger.
 	OnReading(ctx context.Context, conn Conn, data []byte, ch chan<- []byte) (processed bool, err error)
 	// OnWriting handles writing event for tcp mode.
 	//
@@ -20,6 +27,11 @@ type Interceptor interface {
 	//     c.RawWrite(data)
 	// By default, after OnWriting do nothing, internal loop will write data
 	// to tcp connection rawly.
+	//
+	// data is a pooled buffer owned by the writing loop, do not retain
+	// it after OnWriting returned.
+	//
+	// ctx is the per-connection context as OnReading.
 	OnWriting(ctx context.Context, conn Conn, data []byte) (processed bool, err error)
 }
 
@@ -42,8 +54,8 @@ type ErrorAware interface {
 
 type ServerInterceptor interface {
 	OnListened(baseCtx context.Context, addr string)
-	OnServerReady(ctx context.Context) // ctx.Value["conn"] -> api.Conn
-	OnServerClosed()                   // ctx.Value["logger"] -> log/slog or logg/slog
+	OnServerReady(ctx context.Context)
+	OnServerClosed()
 
 	Interceptor
 }
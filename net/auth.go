@@ -0,0 +1,417 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+var (
+	// ErrAuthSkipped is returned by an Authenticator which does not
+	// apply to the connection, such as TLSCertAuth on a plain one, so
+	// that FirstOf tries the next.
+	ErrAuthSkipped = errors.New("authentication mechanism not applicable")
+	// ErrAuthFailed is returned by an Authenticator if the client
+	// cannot be authenticated.
+	ErrAuthFailed = errors.New("authentication failed")
+)
+
+const defaultAuthTimeout = 10 * time.Second
+
+// Principal is the identity of an authenticated connection, see
+// PrincipalOf.
+type Principal struct {
+	Name      string            // the user name, or the one told by the verifier
+	Mechanism string            // "token", "PLAIN", "CRAM-MD5", "tls" or "peercred"
+	Cert      *x509.Certificate // the client certificate, by TLSCertAuth
+	Cred      *api.PeerCred     // the peer credentials, by PeerCredAuth
+}
+
+// Authenticator authenticates a connection before it is served.
+//
+// It may talk with the client through conn, by the lines. A failed
+// authentication closes the connection.
+type Authenticator interface {
+	Authenticate(ctx context.Context, conn *AuthConn) (p *Principal, err error)
+}
+
+// AuthenticatorFunc is an Authenticator function.
+type AuthenticatorFunc func(ctx context.Context, conn *AuthConn) (p *Principal, err error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, conn *AuthConn) (p *Principal, err error) {
+	return f(ctx, conn)
+}
+
+// WithServerAuthenticator authenticates each connection by a before
+// OnClientConnected, Handler.Serve and OnProcessData. The principal
+// is exposed by PrincipalOf.
+//
+// With WithServerResumption, the authentication goes before the
+// resumption handshake, and a session can be resumed by the same
+// principal only. See WithClientAuth for the client.
+func WithServerAuthenticator(a Authenticator) ServerOpt {
+	return func(s *serverWrap) {
+		s.authenticator = a
+	}
+}
+
+// WithServerAuthTimeout sets how long the authentication can take,
+// 10s by default.
+func WithServerAuthTimeout(d time.Duration) ServerOpt {
+	return func(s *serverWrap) {
+		s.authTimeout = d
+	}
+}
+
+// PrincipalOf returns the principal of an authenticated server
+// connection, or nil.
+func PrincipalOf(w api.Response) *Principal {
+	if c, ok := w.(*connS); ok {
+		return c.Principal()
+	}
+	return nil
+}
+
+// Principal returns the principal authenticated, or nil.
+func (s *connS) Principal() *Principal { return s.principal }
+
+// authenticate runs the authenticator. It returns false if the
+// connection should be closed.
+func (s *connS) authenticate(ctx context.Context) bool {
+	timeout := s.authTimeout
+	if timeout <= 0 {
+		timeout = defaultAuthTimeout
+	}
+	conn := s.conn.Load()
+	if conn == nil {
+		return false
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		s.Debug("[connS] authentication failed", "err", err)
+		return false
+	}
+	ac := &AuthConn{c: s, br: bufio.NewReaderSize(conn, s.bufferSize)}
+	p, err := s.authenticator.Authenticate(ctx, ac)
+	if err == nil && p == nil {
+		err = ErrAuthFailed
+	}
+	if err != nil {
+		s.Warn("[connS] authentication failed", "err", err)
+		return false
+	}
+	if err = conn.SetDeadline(time.Time{}); err != nil {
+		return false
+	}
+	s.principal = p
+	s.unread(ac.buffered())
+	s.Debug("[connS] authenticated", "principal", p.Name, "mechanism", p.Mechanism)
+	return true
+}
+
+// unread makes the bytes read ahead readable again from s.conn.
+func (s *connS) unread(lead []byte) {
+	if len(lead) == 0 {
+		return
+	}
+	s.conn.Store(&sniffedConn{Conn: s.conn.Load(), lead: lead})
+}
+
+// baseConn returns the connection under the wrappers of this package.
+func baseConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *resumeConn:
+			conn = c.Conn
+		case *sniffedConn:
+			conn = c.Conn
+		case *filesConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+// AuthConn is the connection being authenticated. The reading and
+// writing loops are not started yet, so it reads and writes the
+// connection directly.
+type AuthConn struct {
+	c  *connS
+	br *bufio.Reader
+}
+
+// ReadLine reads a line, without the trailing "\r\n". The line must
+// fit in the reading buffer of WithServerMaxMessageLength bytes, a
+// longer one fails with bufio.ErrBufferFull.
+func (a *AuthConn) ReadLine() (line string, err error) {
+	var b []byte
+	if b, err = a.br.ReadSlice('\n'); err != nil {
+		return
+	}
+	return string(bytes.TrimRight(b, "\r\n")), nil
+}
+
+// WriteLine writes line, ending with "\n".
+func (a *AuthConn) WriteLine(line string) (err error) {
+	if conn := a.c.conn.Load(); conn != nil {
+		_, err = conn.Write([]byte(line + "\n"))
+	} else {
+		err = net.ErrClosed
+	}
+	return
+}
+
+// Conn returns the underlying connection, to inspect the TLS state or
+// the peer credentials. Do not read from it.
+func (a *AuthConn) Conn() net.Conn { return baseConn(a.c.conn.Load()) }
+
+// buffered returns the bytes read ahead.
+func (a *AuthConn) buffered() []byte {
+	n := a.br.Buffered()
+	if n == 0 {
+		return nil
+	}
+	b, _ := a.br.Peek(n)
+	return append([]byte(nil), b...)
+}
+
+// reply writes "+OK" if err is nil, or "-ERR <err>". The errors of
+// the user verifiers are not replied, see TokenAuth.
+func (a *AuthConn) reply(err error) error {
+	if err != nil {
+		_ = a.WriteLine("-ERR " + err.Error())
+		return err
+	}
+	return a.WriteLine("+OK")
+}
+
+// FirstOf tries the authenticators in order, till one does not return
+// ErrAuthSkipped.
+func FirstOf(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, conn *AuthConn) (p *Principal, err error) {
+		for _, a := range auths {
+			if p, err = a.Authenticate(ctx, conn); !errors.Is(err, ErrAuthSkipped) {
+				return
+			}
+		}
+		return nil, ErrAuthFailed
+	})
+}
+
+// TokenAuth expects a token in the first line, and replies "+OK" or
+// "-ERR authentication failed". verify returns the principal name of
+// token; its error is returned by Authenticate, but not told to the
+// client.
+func TokenAuth(verify func(token string) (name string, err error)) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, conn *AuthConn) (p *Principal, err error) {
+		var token, name string
+		if token, err = conn.ReadLine(); err != nil {
+			return
+		}
+		if name, err = verify(token); err != nil {
+			_ = conn.reply(ErrAuthFailed)
+			return
+		}
+		return &Principal{Name: name, Mechanism: "token"}, conn.reply(nil)
+	})
+}
+
+// SharedTokenAuth is a TokenAuth of a token shared by all clients,
+// named name.
+func SharedTokenAuth(token, name string) Authenticator {
+	return TokenAuth(func(got string) (string, error) {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			return "", ErrAuthFailed
+		}
+		return name, nil
+	})
+}
+
+// SASLAuth authenticates by the SASL mechanisms in the lines, as the
+// AUTH command of SMTP:
+//
+//	C: AUTH PLAIN <base64 of "authzid\0user\0password">
+//	S: +OK
+//
+//	C: AUTH CRAM-MD5
+//	S: + <base64 of the challenge>
+//	C: <base64 of "user hex(hmac-md5(password, challenge))">
+//	S: +OK
+//
+// The initial response of PLAIN can be sent after a "+ " line too.
+// password returns the password of user. mechanisms are "PLAIN" and
+// "CRAM-MD5", both by default.
+func SASLAuth(password func(user string) (pass string, ok bool), mechanisms ...string) Authenticator {
+	if len(mechanisms) == 0 {
+		mechanisms = []string{"PLAIN", "CRAM-MD5"}
+	}
+	return AuthenticatorFunc(func(ctx context.Context, conn *AuthConn) (p *Principal, err error) {
+		var line string
+		if line, err = conn.ReadLine(); err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) < 2 || len(f) > 3 || !strings.EqualFold(f[0], "AUTH") {
+			return nil, conn.reply(errors.New("expect AUTH"))
+		}
+		mech := strings.ToUpper(f[1])
+		if !containsFold(mechanisms, mech) {
+			return nil, conn.reply(fmt.Errorf("unsupported mechanism %s", mech))
+		}
+
+		var user string
+		switch mech {
+		case "PLAIN":
+			var resp string
+			if len(f) == 3 {
+				resp = f[2]
+			} else if resp, err = conn.challenge(""); err != nil {
+				return
+			}
+			user, err = saslPlain(resp, password)
+		case "CRAM-MD5":
+			var nonce [8]byte
+			_, _ = rand.Read(nonce[:])
+			challenge := fmt.Sprintf("<%x.%d@go-socketlib>", nonce, time.Now().Unix())
+			var resp string
+			if resp, err = conn.challenge(base64.StdEncoding.EncodeToString([]byte(challenge))); err != nil {
+				return
+			}
+			user, err = saslCRAMMD5(resp, challenge, password)
+		}
+		if err != nil {
+			return nil, conn.reply(err)
+		}
+		return &Principal{Name: user, Mechanism: mech}, conn.reply(nil)
+	})
+}
+
+// challenge sends "+ <c>", and reads the response.
+func (a *AuthConn) challenge(c string) (resp string, err error) {
+	if err = a.WriteLine(strings.TrimSpace("+ " + c)); err == nil {
+		resp, err = a.ReadLine()
+	}
+	return
+}
+
+func saslPlain(resp string, password func(user string) (string, bool)) (user string, err error) {
+	b, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return "", ErrAuthFailed
+	}
+	parts := strings.Split(string(b), "\x00")
+	if len(parts) != 3 || parts[0] != "" && parts[0] != parts[1] {
+		return "", ErrAuthFailed
+	}
+	pass, ok := password(parts[1])
+	if !ok || subtle.ConstantTimeCompare([]byte(parts[2]), []byte(pass)) != 1 {
+		return "", ErrAuthFailed
+	}
+	return parts[1], nil
+}
+
+func saslCRAMMD5(resp, challenge string, password func(user string) (string, bool)) (user string, err error) {
+	b, err := base64.StdEncoding.DecodeString(resp)
+	if err != nil {
+		return "", ErrAuthFailed
+	}
+	i := strings.LastIndexByte(string(b), ' ') // RFC 2195, the digest follows the last space
+	if i < 0 {
+		return "", ErrAuthFailed
+	}
+	user, digest := string(b[:i]), string(b[i+1:])
+	pass, ok := password(user)
+	if !ok {
+		return "", ErrAuthFailed
+	}
+	h := hmac.New(md5.New, []byte(pass))
+	h.Write([]byte(challenge))
+	if !hmac.Equal([]byte(digest), []byte(hex.EncodeToString(h.Sum(nil)))) {
+		return "", ErrAuthFailed
+	}
+	return user, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSCertAuth authenticates by the verified client certificate of a
+// TLS connection, see WithServerTLSConfig and tls.Config.ClientAuth.
+// verify returns the principal name of cert, the subject common name
+// if verify is nil.
+//
+// It returns ErrAuthSkipped if the connection is not TLS, or the
+// client sent no certificate, and ErrAuthFailed if the certificate
+// was not verified, such as by tls.RequireAnyClientCert.
+func TLSCertAuth(verify func(cert *x509.Certificate) (name string, err error)) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, conn *AuthConn) (p *Principal, err error) {
+		tc, ok := conn.Conn().(*tls.Conn)
+		if !ok {
+			return nil, ErrAuthSkipped
+		}
+		if err = tc.HandshakeContext(ctx); err != nil {
+			return
+		}
+		state := tc.ConnectionState()
+		if len(state.PeerCertificates) == 0 {
+			return nil, ErrAuthSkipped
+		}
+		if len(state.VerifiedChains) == 0 {
+			return nil, ErrAuthFailed
+		}
+		cert := state.VerifiedChains[0][0]
+		name := cert.Subject.CommonName
+		if verify != nil {
+			if name, err = verify(cert); err != nil {
+				return
+			}
+		}
+		return &Principal{Name: name, Mechanism: "tls", Cert: cert}, nil
+	})
+}
+
+// PeerCredAuth authenticates by the credentials of the peer process
+// of a unix domain socket, on Linux. verify returns the principal
+// name of cred, the uid if verify is nil.
+//
+// It returns ErrAuthSkipped if the connection is not a unix domain
+// socket.
+func PeerCredAuth(verify func(cred api.PeerCred) (name string, err error)) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, conn *AuthConn) (p *Principal, err error) {
+		var cred api.PeerCred
+		if cred, err = peerCred(conn.Conn()); errors.Is(err, api.ErrPeerCredUnsupported) {
+			return nil, ErrAuthSkipped
+		} else if err != nil {
+			return
+		}
+		name := strconv.Itoa(cred.UID)
+		if verify != nil {
+			if name, err = verify(cred); err != nil {
+				return
+			}
+		}
+		return &Principal{Name: name, Mechanism: "peercred", Cred: &cred}, nil
+	})
+}
@@ -0,0 +1,209 @@
+package net
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	stdnet "net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// whoamiProcessor replies the principal name and mechanism to each
+// line.
+func whoamiProcessor(data []byte, w api.Response, r api.Request) (nn int, err error) {
+	p := PrincipalOf(w)
+	_, err = w.Write([]byte(p.Name + " " + p.Mechanism + "\n"))
+	return len(data), err
+}
+
+func TestServer_authToken(t *testing.T) {
+	addr, _ := startTestServer(t,
+		WithServerAuthenticator(FirstOf(TLSCertAuth(nil), SharedTokenAuth("s3cret", "robot"))),
+		WithServerOnProcessData(whoamiProcessor),
+	)
+
+	conn, scanner := dialLines(t, addr)
+	_, _ = conn.Write([]byte("wrong\n"))
+	expectLines(t, scanner, "-ERR authentication failed")
+	if scanner.Scan() {
+		t.Fatalf("expect the connection closed, but got %q", scanner.Text())
+	}
+
+	conn, scanner = dialLines(t, addr)
+	_, _ = conn.Write([]byte("s3cret\nwho\n")) // the bytes after the token go to the processor
+	expectLines(t, scanner, "+OK", "robot token")
+}
+
+func TestServer_authSASL(t *testing.T) {
+	addr, _ := startTestServer(t,
+		WithServerAuthenticator(SASLAuth(func(user string) (string, bool) {
+			return "tanstaaf", user == "tim" || user == "tim smith"
+		})),
+		WithServerOnProcessData(whoamiProcessor),
+	)
+
+	conn, scanner := dialLines(t, addr)
+	_, _ = conn.Write([]byte("AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00tim\x00tanstaaf")) + "\nwho\n"))
+	expectLines(t, scanner, "+OK", "tim PLAIN")
+
+	conn, scanner = dialLines(t, addr)
+	_, _ = conn.Write([]byte("AUTH CRAM-MD5\n"))
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "+ ") {
+		t.Fatalf("expect a challenge, but got %q", scanner.Text())
+	}
+	challenge, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(scanner.Text(), "+ "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := hmac.New(md5.New, []byte("tanstaaf"))
+	h.Write(challenge)
+	resp := base64.StdEncoding.EncodeToString([]byte("tim smith " + hex.EncodeToString(h.Sum(nil))))
+	_, _ = conn.Write([]byte(resp + "\nwho\n"))
+	expectLines(t, scanner, "+OK", "tim smith CRAM-MD5") // the digest follows the last space
+}
+
+func TestServer_authTokenReason(t *testing.T) {
+	addr, _ := startTestServer(t,
+		WithServerAuthenticator(TokenAuth(func(token string) (string, error) {
+			return "", errors.New("token store unreachable at 10.0.0.7")
+		})),
+		WithServerOnProcessData(whoamiProcessor),
+	)
+	conn, scanner := dialLines(t, addr)
+	_, _ = conn.Write([]byte("s3cret\n"))
+	expectLines(t, scanner, "-ERR authentication failed") // the reason stays on the server
+}
+
+func TestServer_authPeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are supported on linux only")
+	}
+	path := filepath.Join(t.TempDir(), "auth.sock")
+	startUnixTestServer(t, path,
+		WithServerAuthenticator(PeerCredAuth(nil)),
+		WithServerOnProcessData(whoamiProcessor),
+	)
+
+	conn, err := stdnet.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	_, _ = conn.Write([]byte("who\n"))
+	expectLines(t, scanner, strconv.Itoa(os.Getuid())+" peercred")
+}
+
+func TestServer_authTLSCert(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig.ClientCAs = x509.NewCertPool()
+	serverConfig.ClientCAs.AddCert(cert)
+	serverConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	clientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}
+
+	addr, _ := startTestServer(t,
+		WithServerTLSConfig(serverConfig),
+		WithServerAuthenticator(FirstOf(TLSCertAuth(nil), SharedTokenAuth("s3cret", "robot"))),
+		WithServerOnProcessData(whoamiProcessor),
+	)
+
+	dial := func(config *tls.Config) (*tls.Conn, *bufio.Scanner) {
+		t.Helper()
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewScanner(conn)
+	}
+
+	conn, scanner := dial(clientConfig)
+	_, _ = conn.Write([]byte("who\n"))
+	expectLines(t, scanner, "alice tls")
+
+	// no certificate, the token goes next
+	noCert := clientConfig.Clone()
+	noCert.Certificates = nil
+	conn, scanner = dial(noCert)
+	_, _ = conn.Write([]byte("s3cret\nwho\n"))
+	expectLines(t, scanner, "+OK", "robot token")
+}
+
+func TestServer_authTLSCertUnverified(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "admin"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key) // self-signed
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig.ClientAuth = tls.RequireAnyClientCert
+	clientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}
+
+	addr, _ := startTestServer(t,
+		WithServerTLSConfig(serverConfig),
+		WithServerAuthenticator(TLSCertAuth(nil)),
+		WithServerOnProcessData(whoamiProcessor),
+	)
+	conn, err := tls.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	_, _ = conn.Write([]byte("who\n"))
+	if scanner.Scan() {
+		t.Fatalf("expect the unverified certificate rejected, but got %q", scanner.Text())
+	}
+}
@@ -0,0 +1,81 @@
+// Package bufpool provides the shared byte buffers used by the hot
+// paths of socketlib, such as the reading loops, the cached writing
+// queues and the codecs.
+//
+// The ownership rules are:
+//
+//   - A buffer returned by Get or Clone is owned by the caller.
+//   - Put (or Frame.Release) gives the buffer back to the pool, and
+//     the caller must not touch it anymore.
+//   - A buffer must be put back at most once. Forgetting to put it
+//     back is harmless, the garbage collector will reclaim it.
+//   - A buffer is recognized by its capacity, so do not reslice it
+//     from the front (b[i:]) before putting it back.
+package bufpool
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// classes are the capacities of pooled buffers. A larger request is
+// allocated directly and dropped by Put.
+var classes = [...]int{512, 1 << 10, 2 << 10, 4 << 10, 8 << 10, 16 << 10, 32 << 10, 64 << 10}
+
+// pools holds the pointer to the first byte of a buffer, which can
+// be boxed into an interface without allocation.
+var pools [len(classes)]sync.Pool
+
+// MaxSize is the capacity of the largest pooled buffer.
+const MaxSize = 64 << 10
+
+func classOf(size int) int {
+	for i, c := range classes {
+		if size <= c {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get returns a buffer with length size from the pool.
+func Get(size int) []byte {
+	i := classOf(size)
+	if i < 0 {
+		return make([]byte, size)
+	}
+	if p, ok := pools[i].Get().(*byte); ok {
+		return unsafe.Slice(p, classes[i])[:size]
+	}
+	return make([]byte, size, classes[i])
+}
+
+// Put gives b back to the pool. b is dropped if its capacity is not
+// one of the pooled classes.
+func Put(b []byte) {
+	c := cap(b)
+	if c == 0 {
+		return
+	}
+	if i := classOf(c); i >= 0 && classes[i] == c {
+		pools[i].Put(unsafe.SliceData(b[:1]))
+	}
+}
+
+// Clone copies data into a pooled buffer.
+func Clone(data []byte) Frame {
+	b := Get(len(data))
+	copy(b, data)
+	return b
+}
+
+// Frame is a pooled byte slice handed to its receiver, such as a
+// message decoded by a codec. The receiver owns it and should call
+// Release once done.
+type Frame []byte
+
+// Bytes returns the content of the frame.
+func (f Frame) Bytes() []byte { return f }
+
+// Release gives the frame back to the pool.
+func (f Frame) Release() { Put(f) }
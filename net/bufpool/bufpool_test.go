@@ -0,0 +1,38 @@
+package bufpool
+
+import (
+	"testing"
+)
+
+func TestGetPut(t *testing.T) {
+	for _, c := range []struct{ size, cap int }{
+		{1, 512},
+		{512, 512},
+		{513, 1024},
+		{4096, 4096},
+		{MaxSize, MaxSize},
+		{MaxSize + 1, MaxSize + 1},
+	} {
+		b := Get(c.size)
+		if len(b) != c.size || cap(b) != c.cap {
+			t.Fatalf("Get(%d): expect len %d cap %d, but got len %d cap %d", c.size, c.size, c.cap, len(b), cap(b))
+		}
+		Put(b)
+	}
+
+	f := Clone([]byte("hello"))
+	if string(f.Bytes()) != "hello" {
+		t.Fatalf("expect cloned frame 'hello', but got %q", f)
+	}
+	f.Release()
+}
+
+func TestGetPut_noAlloc(t *testing.T) {
+	Put(Get(4096))
+	allocs := testing.AllocsPerRun(100, func() {
+		Put(Get(4096))
+	})
+	if allocs > 0 {
+		t.Fatalf("expect zero allocation, but got %v", allocs)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/hedzr/go-socketlib/net/api"
+	"github.com/hedzr/go-socketlib/net/bufpool"
 )
 
 func NewClient(opts ...ClientOpt) *clientS {
@@ -21,14 +22,15 @@ func NewClient(opts ...ClientOpt) *clientS {
 		dialTimeout:  15 * time.Second,
 		writeTimeout: 5 * time.Second,
 		bufferSize:   defaultBufferSize,
-		chWriteSize:  16,
+		chWriteSize:  defaultWriteQueueSize,
+		wbSize:       defaultWriteBatchSize,
 		wl:           &sync.Mutex{},
 		baseS:        newBaseS(),
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
-	s.chWrite = make(chan []byte, s.chWriteSize)
+	s.wq = newWriteQueue(s.chWriteSize, s.wqPolicy)
 	s.chPkg = make(chan []byte, s.chWriteSize)
 	return s
 }
@@ -53,25 +55,77 @@ func WithClientLoggerHandler(h slog.Handler) ClientOpt {
 	}
 }
 
+// WithClientMaxMessageLength sets the size of the reading buffer,
+// which is the max length of a message kept by the interceptor of
+// NewTypedClient. Default is 4096.
+func WithClientMaxMessageLength(l int) ClientOpt {
+	return func(s *clientS) {
+		s.bufferSize = l
+	}
+}
+
+// WithClientAuth makes Dial authenticate by auth, which talks with
+// the authenticator of the server on conn directly, before the
+// resumption handshake of WithClientResumption. Returning an error
+// fails the dialing.
+func WithClientAuth(auth func(conn net.Conn) error) ClientOpt {
+	return func(s *clientS) {
+		s.auth = auth
+	}
+}
+
 func WithClientSendCacheSize(size int) ClientOpt {
 	return func(s *clientS) {
 		s.chWriteSize = size
 	}
 }
 
+// WithClientWriteBatch sets how the writing loop coalesces the
+// cached messages into one vectored write (writev).
+//
+// See also WithServerWriteBatch.
+func WithClientWriteBatch(maxBatch int, flushDelay time.Duration) ClientOpt {
+	return func(s *clientS) {
+		s.wbSize, s.wbDelay = maxBatch, flushDelay
+	}
+}
+
+// WithClientWriteQueuePolicy sets the policy applied by a cached
+// Write while the sending cache is full.
+//
+// Default is WriteQueueBlock.
+func WithClientWriteQueuePolicy(p WriteQueuePolicy) ClientOpt {
+	return func(s *clientS) {
+		s.wqPolicy = p
+	}
+}
+
 type clientS struct {
 	dialTimeout         time.Duration
 	writeTimeout        time.Duration
 	interval            time.Duration
 	protocolInterceptor api.Interceptor //
-	conn                net.Conn
+	conn                connRef
 	closed              int32
 	bufferSize          int
 	chWriteSize         int
-	chWrite             chan []byte // cacheable writing channel
-	chPkg               chan []byte // reserved for package parsing
-	wl                  sync.Locker
+	wqPolicy            WriteQueuePolicy
+	wq                  *writeQueue                     // cacheable writing queue
+	wbSize              int                             // max messages coalesced into one writev
+	wbDelay             time.Duration                   // how long to wait for more messages before flushing a batch
+	chPkg               chan []byte                     // reserved for package parsing
+	wl                  sync.Locker                     //
+	ctx                 atomic.Pointer[context.Context] // the context of Run(), for blocking cached writes
 	timesTimeout        int
+	hj                  hijackState
+	tp                  readPause
+	tlsGen              int32        // increased by StartTLS, the bytes read before are plaintext
+	rs                  *ResumeState // non-nil if resuming the sessions
+	auth                func(conn net.Conn) error
+	passFiles           int         // max files received per message, 0 to disable
+	dialer              *net.Dialer // user-defined dialer
+	sockOpts            socketOptions
+	half                halfState
 
 	baseS
 }
@@ -89,6 +143,12 @@ type Client interface {
 	Dial(network, addr string) (err error)
 
 	api.Writeable
+	api.AsyncWriteable
+	api.Hijacker
+	api.TLSUpgrader
+	api.PeerCredentials
+	api.FilePasser
+	api.HalfCloser
 
 	io.Reader
 
@@ -100,60 +160,143 @@ type Client interface {
 }
 
 func (c *clientS) RemoteAddr() net.Addr {
-	if c.conn == nil {
+	conn := c.conn.Load()
+	if conn == nil {
 		return nil
 	}
-	return c.conn.RemoteAddr()
+	return conn.RemoteAddr()
 }
 func (c *clientS) RemoteAddrString() string {
-	if c.conn == nil {
+	conn := c.conn.Load()
+	if conn == nil {
 		return "(not-connected)"
 	}
-	return c.conn.RemoteAddr().String()
+	return conn.RemoteAddr().String()
 }
 func (c *clientS) LocalAddr() net.Addr {
-	if c.conn == nil {
+	conn := c.conn.Load()
+	if conn == nil {
 		return nil
 	}
-	return c.conn.LocalAddr()
+	return conn.LocalAddr()
 }
 
+func (c *clientS) WriteQueueLen() int       { return c.wq.Len() }
+func (c *clientS) WriteQueueCap() int       { return c.wq.Cap() }
+func (c *clientS) WriteQueueDropped() int64 { return c.wq.Dropped() }
+
 func (c *clientS) ProtocolInterceptor() api.Interceptor      { return c.protocolInterceptor }
 func (c *clientS) SetProtocolInterceptor(pi api.Interceptor) { c.protocolInterceptor = pi }
 func (c *clientS) Closed() bool                              { return atomic.LoadInt32(&c.closed) != 0 }
 func (c *clientS) NotClosed() bool                           { return atomic.LoadInt32(&c.closed) == 0 }
-func (c *clientS) Connected() bool                           { return c.conn != nil }
+func (c *clientS) Connected() bool                           { return c.conn.Load() != nil }
 
 // Close makes clientS shutting down itself.
 func (c *clientS) Close() {
 	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
-		if c.conn != nil {
-			if err := c.conn.Close(); err != nil {
+		c.wq.close()
+		if conn := c.conn.Swap(nil); conn != nil {
+			if err := conn.Close(); err != nil {
 				c.Error("close client failed", "err", err)
 			}
-			c.conn = nil
 		}
+		c.baseS.Close()
 	}
-	c.baseS.Close()
 	return
 }
 
 func (c *clientS) Dial(network, addr string) (err error) {
-	c.conn, err = net.DialTimeout(network, addr, c.dialTimeout)
+	var conn net.Conn
+	if conn, err = c.newDialer().Dial(network, addr); err != nil {
+		return
+	}
+	if err = c.sockOpts.applyConn(conn); err != nil {
+		c.Warn("[client] cannot apply socket options", "err", err)
+		err = nil
+	}
+	if c.passFiles > 0 {
+		conn = wrapFiles(conn, c.passFiles)
+	}
+	if ic, ok := conn.(*net.IPConn); ok {
+		conn = &ipConn{ic}
+	}
+	if c.auth != nil {
+		if err = c.auth(conn); err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+	if c.rs != nil {
+		if err = c.rs.handshake(conn, c.dialTimeout); err != nil {
+			_ = conn.Close()
+			return
+		}
+	}
+	c.conn.Store(conn)
 	return
 }
 
 func (c *clientS) Write(data []byte) (n int, err error) {
+	return c.WriteContext(c.connCtx(), data)
+}
+
+// WriteContext puts data into the sending cache. If the cache is
+// full, the client's WriteQueuePolicy is applied, and ctx is used
+// by WriteQueueBlock policy.
+func (c *clientS) WriteContext(ctx context.Context, data []byte) (n int, err error) {
 	if n = len(data); n > 0 {
-		c.chWrite <- data
-		c.Trace("[client] Write() cached one message.")
+		if err = c.enqueue(ctx, newPooledWriteReq(data, false, nil)); err != nil {
+			n = 0
+		}
 	}
 	return
 }
 
+func (c *clientS) WriteAsync(ctx context.Context, data []byte) api.WriteCompletion {
+	if len(data) == 0 {
+		return resolvedWrite(0, nil)
+	}
+	req := newPooledWriteReq(data, true, nil)
+	_ = c.enqueue(ctx, req)
+	return req
+}
+
+func (c *clientS) WriteWithCallback(ctx context.Context, data []byte, cb func(n int, err error)) {
+	if len(data) == 0 {
+		if cb != nil {
+			cb(0, nil)
+		}
+		return
+	}
+	_ = c.enqueue(ctx, newPooledWriteReq(data, false, cb))
+}
+
+func (c *clientS) enqueue(ctx context.Context, req *writeReq) (err error) {
+	if req.data != nil && c.half.has(halfWrite) { // the barriers pass
+		req.resolve(0, api.ErrWriteClosed)
+		return api.ErrWriteClosed
+	}
+	var disconnect bool
+	if disconnect, err = c.wq.push(ctx, req); err != nil {
+		if disconnect {
+			c.Warn("[client] sending cache full, disconnecting", "server.addr", c.RemoteAddrString(), "queue.len", c.wq.Len())
+			c.Close()
+		}
+		return
+	}
+	c.Trace("[client] Write() cached one message.")
+	return
+}
+
+// RawWrite writes data to the connection immediately. The deadline
+// of ctx is applied if it is earlier than the default write timeout,
+// and the writing is interrupted if ctx is cancelled.
 func (c *clientS) RawWrite(ctx context.Context, data []byte) (n int, err error) {
+	if c.half.has(halfWrite) {
+		return 0, api.ErrWriteClosed
+	}
 	if n = len(data); n > 0 {
-		n, err = c.rawWriteNow(data, c.writeTimeout)
+		n, err = writeContext(ctx, &c.conn, c.wl, data, c.writeTimeout)
 	}
 	return
 }
@@ -170,12 +313,35 @@ func (c *clientS) RawWriteTimeout(data []byte, deadline ...time.Duration) (n int
 }
 
 func (c *clientS) rawWriteNow(data []byte, deadline time.Duration) (n int, err error) {
-	err = c.conn.SetWriteDeadline(time.Now().Add(deadline))
+	c.wl.Lock() // lock before taking c.conn, which StartTLS replaces under the lock
+	defer c.wl.Unlock()
+	conn := c.conn.Load()
+	if conn == nil {
+		return 0, net.ErrClosed
+	}
+	if c.half.has(halfWrite) {
+		return 0, api.ErrWriteClosed
+	}
+	if err = conn.SetWriteDeadline(time.Now().Add(deadline)); err == nil {
+		n, err = conn.Write(data)
+	}
+	return
+}
 
-	if err == nil {
-		c.wl.Lock()
-		defer c.wl.Unlock()
-		n, err = c.conn.Write(data)
+// rawWriteBuffers sends bufs with one vectored write if the
+// underlying connection supports it.
+func (c *clientS) rawWriteBuffers(bufs net.Buffers) (n int64, err error) {
+	c.wl.Lock()
+	defer c.wl.Unlock()
+	conn := c.conn.Load()
+	if conn == nil {
+		return 0, net.ErrClosed
+	}
+	if c.half.has(halfSealed) { // queued behind the barrier of CloseWrite
+		return 0, api.ErrWriteClosed
+	}
+	if err = conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err == nil {
+		n, err = bufs.WriteTo(conn)
 	}
 	return
 }
@@ -186,12 +352,31 @@ func (c *clientS) Read(p []byte) (n int, err error) {
 	return
 }
 
+// connCtx returns the context of Run, or the background context
+// before Run.
+func (c *clientS) connCtx() context.Context {
+	if p := c.ctx.Load(); p != nil {
+		return *p
+	}
+	return context.Background()
+}
+
 func (c *clientS) Run(ctx context.Context) {
+	c.ctx.Store(&ctx)
 	go c.runLoop(ctx)
 }
 
 func (c *clientS) runLoop(ctx context.Context) {
-	defer c.Close()
+	if !c.hj.startLoops() {
+		return
+	}
+	defer func() {
+		defer close(c.hj.writeDone)
+		if !c.hj.isHijacked() {
+			c.Close()
+			c.wq.discard(net.ErrClosed)
+		}
+	}()
 	c.Verbose("[client] looper - entering...")
 	go c.readBump(ctx)
 
@@ -205,41 +390,54 @@ writeBump:
 		case _ = <-c.chPkg:
 			// obsolete the split package
 
-		case data := <-c.chWrite:
+		case <-c.hj.stop:
+			c.Debug("[client] looper - ended, hijacked.")
+			c.flushPending(ctx)
+			break writeBump
+
+		case req := <-c.wq.ch:
 			c.Verbose("[client] rawWriteNow() wake up.")
 			if c.NotClosed() {
-				if pi, ld := c.protocolInterceptor, len(data); pi != nil && ld > 0 {
-					if processed, err := pi.OnWriting(ctx, c, data); processed {
-						continue
-					} else if err != nil {
-						c.Error("[client] Write failed", "err", err)
-						break writeBump
-					}
-				}
-				if _, err := c.rawWriteNow(data, c.writeTimeout); err != nil {
+				batch := c.wq.drain(req, c.wbSize, c.wbDelay)
+				if err := writeBatch(ctx, c.protocolInterceptor, c, batch, c.rawWriteBuffers); err != nil {
 					c.Error("[client] Write failed", "err", err)
 					break writeBump
 				}
+			} else {
+				req.resolve(0, net.ErrClosed)
 			}
 		}
 	}
 }
 
 func (c *clientS) readBump(ctx context.Context) {
-	buf := make([]byte, c.bufferSize)
+	buf := bufpool.Get(c.bufferSize)
+	defer bufpool.Put(buf)
+	defer close(c.hj.readDone)
 workingLoop:
 	for c.NotClosed() {
 		c.Verbose("[client] looper/readBump - reading...")
-		if n, err := c.conn.Read(buf); err != nil {
+		conn := c.conn.Load()
+		if conn == nil {
+			break
+		}
+		if n, err := conn.Read(buf); err != nil {
+			if n == 0 && c.tp.park() {
+				continue // resumed after StartTLS
+			}
+			if c.hj.isHijacked() {
+				c.hj.handBack(buf[:n])
+				break workingLoop
+			}
 			if errors.Is(err, io.EOF) {
 				if n > 0 {
 					c.Warn("[client]    tcp: EOF reached with some bytes", "how-many-bytes", n)
 				}
-				if c.Closed() {
+				if c.Closed() || c.half.has(halfRead) {
 					c.Debug("[client]     tcp: EOF reached. socket broken or closed")
 					break workingLoop
 				}
-				err = checkConn(c.conn) // try inspecting raw error
+				err = checkConn(conn) // try inspecting raw error
 				if err != nil && !errors.Is(err, io.EOF) {
 					c.Error("[client]     tcp: checked underlying connection", "err", err)
 				} else {
@@ -276,8 +474,18 @@ workingLoop:
 			default:
 			}
 
-			if _, err = c.tryHandleData(ctx, buf[:n]); err != nil {
+			if c.rs != nil {
+				c.rs.add(n)
+			}
+			atomic.StoreInt32(&c.hj.inProcess, 1)
+			_, err = c.tryHandleData(ctx, buf[:n])
+			atomic.StoreInt32(&c.hj.inProcess, 0)
+			if err != nil {
 				c.Error("[client] Process data failed", "err", err)
+				c.Close() // nothing reads the connection anymore
+				break workingLoop
+			}
+			if c.hj.isHijacked() {
 				break workingLoop
 			}
 		}
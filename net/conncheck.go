@@ -16,6 +16,35 @@ import (
 
 var errUnexpectedRead = errors.New("unexpected read from socket")
 
+// canWaitReadable reports whether waitReadable works for conn.
+func canWaitReadable(conn net.Conn) bool {
+	_, ok := conn.(syscall.Conn)
+	return ok
+}
+
+// waitReadable blocks till conn has some bytes to read, or it is
+// closed by peer, without consuming anything.
+//
+// The read deadline of conn is honored.
+func waitReadable(conn net.Conn) error {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	return rawConn.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		_, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		// keep waiting if nothing to read, the errors else will be
+		// reported by the following reading.
+		return !errors.Is(err, syscall.EAGAIN) && !errors.Is(err, syscall.EWOULDBLOCK)
+	})
+}
+
 // checkConn trying to inspect the underlying system tcp/udp/unix connection (socket) to dig the state of conn
 func checkConn(conn net.Conn) error {
 	var sysErr error
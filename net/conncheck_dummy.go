@@ -12,3 +12,7 @@ import "net"
 func checkConn(conn net.Conn) error {
 	return nil
 }
+
+func canWaitReadable(conn net.Conn) bool { return false }
+
+func waitReadable(conn net.Conn) error { return nil }
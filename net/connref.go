@@ -0,0 +1,42 @@
+package net
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// connRef holds the connection of connS and clientS. It is replaced
+// by StartTLS and cleared by Close, while the reading, writing and
+// worker goroutines are using it.
+type connRef struct{ p atomic.Pointer[net.Conn] }
+
+// Load returns the connection, or nil after closed.
+func (r *connRef) Load() net.Conn {
+	if p := r.p.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+func (r *connRef) Store(conn net.Conn) { r.p.Store(refOf(conn)) }
+
+// Swap stores conn and returns the previous one.
+func (r *connRef) Swap(conn net.Conn) net.Conn {
+	if p := r.p.Swap(refOf(conn)); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// replace stores conn if the current one is still old.
+func (r *connRef) replace(old, conn net.Conn) bool {
+	p := r.p.Load()
+	return p != nil && *p == old && r.p.CompareAndSwap(p, refOf(conn))
+}
+
+func refOf(conn net.Conn) *net.Conn {
+	if conn == nil {
+		return nil
+	}
+	return &conn
+}
@@ -0,0 +1,87 @@
+package net
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// connCtxKey is the context key of connInfo.
+type connCtxKey struct{}
+
+// connInfo is carried by the per-connection context.
+type connInfo struct {
+	conn     api.Conn
+	logger   Logger
+	id       uint64
+	accepted time.Time
+}
+
+func withConnInfo(ctx context.Context, info *connInfo) context.Context {
+	return context.WithValue(ctx, connCtxKey{}, info)
+}
+
+func connInfoFrom(ctx context.Context) *connInfo {
+	info, _ := ctx.Value(connCtxKey{}).(*connInfo)
+	return info
+}
+
+// ConnFromContext returns the connection of a per-connection context,
+// which is passed to Handler.Serve and the interceptors.
+func ConnFromContext(ctx context.Context) (conn api.Conn, ok bool) {
+	if info := connInfoFrom(ctx); info != nil {
+		return info.conn, true
+	}
+	return
+}
+
+// LoggerFromContext returns the connection logger of a per-connection
+// context, which has the client.addr and conn.id attributes. It
+// returns slog.Default() if ctx is not a per-connection context.
+func LoggerFromContext(ctx context.Context) Logger {
+	if info := connInfoFrom(ctx); info != nil && info.logger != nil {
+		return info.logger
+	}
+	return slog.Default()
+}
+
+// ConnIDFromContext returns the connection ID of a per-connection
+// context. The IDs are unique in a server, starting from 1.
+func ConnIDFromContext(ctx context.Context) (id uint64, ok bool) {
+	if info := connInfoFrom(ctx); info != nil {
+		return info.id, true
+	}
+	return
+}
+
+// AcceptTimeFromContext returns when the connection was accepted.
+func AcceptTimeFromContext(ctx context.Context) (tm time.Time, ok bool) {
+	if info := connInfoFrom(ctx); info != nil {
+		return info.accepted, true
+	}
+	return
+}
+
+// ContextOf returns the per-connection context of a server
+// connection, for the data processors which have no context passed.
+// It returns context.Background() for other responses.
+func ContextOf(w api.Response) context.Context {
+	if c, ok := w.(*connS); ok {
+		return c.connCtx()
+	}
+	return context.Background()
+}
+
+// loggerWith returns a child logger of l with the attributes, or l
+// itself if it cannot have a child.
+func loggerWith(l Logger, args ...any) Logger {
+	switch z := l.(type) {
+	case *slog.Logger:
+		return z.With(args...)
+	case interface{ With(args ...any) Logger }:
+		return z.With(args...)
+	}
+	return l
+}
@@ -0,0 +1,52 @@
+package net
+
+import (
+	"context"
+	"errors"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func TestServer_connContext(t *testing.T) {
+	ctxs := make(chan context.Context, 2)
+	addr, _ := startTestServer(t,
+		WithServerHandlerFunc(func(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+			ctxs <- ctx
+			return
+		}),
+	)
+
+	for i := uint64(1); i <= 2; i++ {
+		conn, err := stdnet.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := <-ctxs
+		if c, ok := ConnFromContext(ctx); !ok || c.RemoteAddrString() != conn.LocalAddr().String() {
+			t.Fatalf("expect the connection in context, but got %v", c)
+		}
+		if id, ok := ConnIDFromContext(ctx); !ok || id != i {
+			t.Fatalf("expect connection id %d, but got %d", i, id)
+		}
+		if tm, ok := AcceptTimeFromContext(ctx); !ok || time.Since(tm) > time.Minute {
+			t.Fatalf("unexpected accept time %v", tm)
+		}
+		if LoggerFromContext(ctx) == nil {
+			t.Fatal("expect a connection logger")
+		}
+
+		_ = conn.Close()
+		select {
+		case <-ctx.Done():
+			if !errors.Is(context.Cause(ctx), stdnet.ErrClosed) {
+				t.Fatalf("expect cancelled by closing, but got %v", context.Cause(ctx))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("context not cancelled after the connection closed")
+		}
+	}
+}
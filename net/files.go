@@ -0,0 +1,162 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var errEmptyFilesMessage = errors.New("cannot pass files without data")
+
+// WithServerPassFiles lets the unix domain socket connections receive
+// the files passed by the clients, up to maxFiles per message, see
+// api.FilePasser. It is unsupported on Windows. More files in a
+// message fail the reading with api.ErrFilesTruncated.
+//
+// The connections are not polled by the reactor, and the reading
+// buffer is not released while idle.
+func WithServerPassFiles(maxFiles int) ServerOpt {
+	return func(s *serverWrap) {
+		s.passFiles = maxFiles
+	}
+}
+
+// WithClientPassFiles lets a unix domain socket client receive the
+// files passed by the server, up to maxFiles per message, see
+// api.FilePasser.
+func WithClientPassFiles(maxFiles int) ClientOpt {
+	return func(s *clientS) {
+		s.passFiles = maxFiles
+	}
+}
+
+// filesConn keeps the files received with the data, see Read.
+type filesConn struct {
+	net.Conn
+	uc    *net.UnixConn
+	oob   []byte // the control message buffer, used by the reading goroutine
+	mu    sync.Mutex
+	files []*os.File
+}
+
+// take returns the files received, and forgets them.
+func (c *filesConn) take() (files []*os.File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files, c.files = c.files, nil
+	return
+}
+
+func (c *filesConn) keep(files ...*os.File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files = append(c.files, files...)
+}
+
+// Close closes the files not taken, and the connection.
+func (c *filesConn) Close() error {
+	for _, f := range c.take() {
+		_ = f.Close()
+	}
+	return c.Conn.Close()
+}
+
+// filesOf returns the filesConn under the wrappers, or nil.
+func filesOf(conn net.Conn) *filesConn {
+	for {
+		switch c := conn.(type) {
+		case *filesConn:
+			return c
+		case *resumeConn:
+			conn = c.Conn
+		case *sniffedConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// writeFiles writes data with files to conn, applying the earlier one
+// of ctx deadline and timeout. It must be called with the write lock.
+func writeFiles(ctx context.Context, conn net.Conn, data []byte, files []*os.File, timeout time.Duration) (err error) {
+	if len(data) == 0 {
+		return errEmptyFilesMessage
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = conn.SetWriteDeadline(deadline); err == nil {
+		err = sendFiles(baseConn(conn), data, files)
+	}
+	return
+}
+
+// SendFiles writes data with files to the client, see
+// api.FilePasser.
+func (s *connS) SendFiles(ctx context.Context, data []byte, files ...*os.File) (err error) {
+	if s.Closed() {
+		return net.ErrClosed
+	}
+	s.hj.mu.Lock()
+	looping := s.hj.looping
+	s.hj.mu.Unlock()
+	if err = s.flushQueued(ctx, looping, nil); err != nil {
+		return
+	}
+
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	conn := s.conn.Load()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	if rc, ok := conn.(*resumeConn); ok && len(data) > 0 {
+		rc.r.record(data) // the files are not replayed
+	}
+	return writeFiles(ctx, conn, data, files, s.writeTimeout)
+}
+
+// ReceivedFiles returns the files received from the client, see
+// api.FilePasser.
+func (s *connS) ReceivedFiles() []*os.File {
+	if fc := filesOf(s.conn.Load()); fc != nil {
+		return fc.take()
+	}
+	return nil
+}
+
+// SendFiles writes data with files to the server, see
+// api.FilePasser.
+func (c *clientS) SendFiles(ctx context.Context, data []byte, files ...*os.File) (err error) {
+	if c.Closed() {
+		return net.ErrClosed
+	}
+	c.hj.mu.Lock()
+	looping := c.hj.looping
+	c.hj.mu.Unlock()
+	if err = c.flushQueued(ctx, looping, nil); err != nil {
+		return
+	}
+
+	c.wl.Lock()
+	defer c.wl.Unlock()
+	conn := c.conn.Load()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	return writeFiles(ctx, conn, data, files, c.writeTimeout)
+}
+
+// ReceivedFiles returns the files received from the server, see
+// api.FilePasser.
+func (c *clientS) ReceivedFiles() []*os.File {
+	if fc := filesOf(c.conn.Load()); fc != nil {
+		return fc.take()
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package net
+
+import (
+	"net"
+	"os"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func wrapFiles(conn net.Conn, maxFiles int) net.Conn { return conn }
+
+func (c *filesConn) Read(p []byte) (n int, err error) { return c.Conn.Read(p) }
+
+func sendFiles(conn net.Conn, data []byte, files []*os.File) error {
+	return api.ErrFilePassingUnsupported
+}
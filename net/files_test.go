@@ -0,0 +1,127 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"io"
+	stdnet "net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// tempFileWith returns a temporary file holding content.
+func tempFileWith(t *testing.T, content string) *os.File {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "passed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// readPassed reads the content of the passed files, and closes them.
+func readPassed(files []*os.File) (content string) {
+	for _, f := range files {
+		b, _ := io.ReadAll(io.NewSectionReader(f, 0, 1<<20))
+		content += string(b)
+		_ = f.Close()
+	}
+	return
+}
+
+// filesInterceptor collects the content of the files passed to the
+// client.
+type filesInterceptor struct {
+	lineCollector
+}
+
+func (fi *filesInterceptor) OnReading(ctx context.Context, conn api.Conn, data []byte, ch chan<- []byte) (processed bool, err error) {
+	fi.lines <- string(data) + readPassed(conn.(api.FilePasser).ReceivedFiles())
+	return true, nil
+}
+
+func TestServer_passFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file passing is unsupported on windows")
+	}
+	reply := tempFileWith(t, "world")
+	path := filepath.Join(t.TempDir(), "files.sock")
+	startUnixTestServer(t, path,
+		WithServerPassFiles(4),
+		WithServerOnProcessData(func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+			fp := w.(api.FilePasser)
+			content := readPassed(fp.ReceivedFiles())
+			err = fp.SendFiles(context.Background(), []byte(string(data)+content+"\n"), reply)
+			return len(data), err
+		}),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fi := &filesInterceptor{lineCollector{lines: make(chan string, 8)}}
+	c := NewClient(WithClientLogger(testLogger()), WithClientInterceptor(fi), WithClientPassFiles(4))
+	if err := c.Dial("unix", path); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Run(ctx)
+
+	if err := c.SendFiles(ctx, []byte("hello "), tempFileWith(t, "from client")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-fi.lines:
+		if got != "hello from client\nworld" {
+			t.Fatalf("unexpected %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestFilesConn_truncated(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file passing is unsupported on windows")
+	}
+	path := filepath.Join(t.TempDir(), "trunc.sock")
+	l, err := stdnet.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := stdnet.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := wrapFiles(conn, 1).(*filesConn)
+	defer fc.Close()
+	_ = fc.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err = sendFiles(client, []byte("hi"), []*os.File{tempFileWith(t, "a"), tempFileWith(t, "b"), tempFileWith(t, "c")}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := fc.Read(buf)
+	if !errors.Is(err, api.ErrFilesTruncated) || string(buf[:n]) != "hi" {
+		t.Fatalf("expect the truncation reported with the data, but got %q, %v", buf[:n], err)
+	}
+	// the buffer of the control message may hold more than the limit
+	// for the alignment, but not all
+	if got := readPassed(fc.take()); got == "" || got == "abc" {
+		t.Fatalf("expect the files within the buffer kept, but got %q", got)
+	}
+}
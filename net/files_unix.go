@@ -0,0 +1,86 @@
+//go:build unix
+
+package net
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// wrapFiles wraps a unix domain socket to receive the files, or
+// returns conn as is.
+func wrapFiles(conn net.Conn, maxFiles int) net.Conn {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok || maxFiles <= 0 {
+		return conn
+	}
+	return &filesConn{Conn: conn, uc: uc, oob: make([]byte, syscall.CmsgSpace(maxFiles*4))}
+}
+
+// Read reads the data, and keeps the files came with it.
+func (c *filesConn) Read(p []byte) (n int, err error) {
+	var oobn, flags int
+	n, oobn, flags, _, err = c.uc.ReadMsgUnix(p, c.oob)
+	if oobn > 0 {
+		c.parseRights(c.oob[:oobn])
+	}
+	if err == nil && flags&syscall.MSG_CTRUNC != 0 {
+		err = api.ErrFilesTruncated // the files over the limit are lost, so is the protocol
+	}
+	if n == 0 && oobn == 0 && err == nil && len(p) > 0 {
+		err = io.EOF // ReadMsgUnix does not tell EOF
+	}
+	return
+}
+
+func (c *filesConn) parseRights(oob []byte) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for i := range msgs {
+		fds, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			c.keep(os.NewFile(uintptr(fd), "passed-file"))
+		}
+	}
+}
+
+// sendFiles writes data with the rights of files.
+func sendFiles(conn net.Conn, data []byte, files []*os.File) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return api.ErrFilePassingUnsupported
+	}
+	return withFDs(files, nil, func(fds []int) (err error) {
+		var n int
+		if n, _, err = uc.WriteMsgUnix(data, syscall.UnixRights(fds...), nil); err == nil && n < len(data) {
+			_, err = uc.Write(data[n:])
+		}
+		return
+	})
+}
+
+// withFDs calls fn with the descriptors of files, which stay valid
+// while fn running. Unlike File.Fd, it keeps the files non-blocking.
+func withFDs(files []*os.File, fds []int, fn func(fds []int) error) error {
+	if len(files) == 0 {
+		return fn(fds)
+	}
+	rc, err := files[0].SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err = rc.Control(func(fd uintptr) { ferr = withFDs(files[1:], append(fds, int(fd)), fn) }); err != nil {
+		return err
+	}
+	return ferr
+}
@@ -0,0 +1,278 @@
+// Package fsm provides a declarative per-connection state machine for
+// the stateful protocols, such as POP3 with its AUTHORIZATION,
+// TRANSACTION and UPDATE states.
+//
+// A Machine declares the states, the commands allowed in each state,
+// the transitions and the timeouts. It works as a router.Middleware,
+// which rejects the out-of-state commands before the handlers:
+//
+//	m := fsm.New[string]("authorization")
+//	m.State("authorization", fsm.Allow("user", "pass"), fsm.Timeout[string](time.Minute))
+//	m.State("transaction", fsm.Allow("stat", "list", "retr", "dele"))
+//	m.Always("quit", "noop")
+//	m.Transition("authorization", "pass", "transaction")
+//
+//	r := router.New(router.FirstWord())
+//	r.Use(m.Middleware())
+package fsm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net"
+	"github.com/hedzr/go-socketlib/net/api"
+	"github.com/hedzr/go-socketlib/net/router"
+)
+
+// State is the name of a state.
+type State string
+
+// ErrStay can be returned by a handler to refuse the command without
+// an error, so that the transition is not taken. The middleware
+// returns nil for it.
+var ErrStay = errors.New("fsm: stay in the state")
+
+// Machine is the definition of a state machine. The current state of
+// a connection is kept in its net.Session.
+type Machine[K comparable] struct {
+	initial     State
+	states      map[State]*stateDef[K]
+	always      map[K]bool
+	transitions map[State]map[K]State
+	onReject    router.HandlerFunc[K]
+	onTimeout   func(w api.Response, s State)
+
+	mu  sync.Mutex                 // guards the instances
+	key *net.SessionKey[*instance] // the state in the connection session
+}
+
+type stateDef[K comparable] struct {
+	allowed map[K]bool
+	timeout time.Duration
+	onEnter func(w api.Response)
+}
+
+// StateOpt configures a state.
+type StateOpt[K comparable] func(sd *stateDef[K])
+
+// Allow allows the commands in the state.
+func Allow[K comparable](keys ...K) StateOpt[K] {
+	return func(sd *stateDef[K]) {
+		for _, k := range keys {
+			sd.allowed[k] = true
+		}
+	}
+}
+
+// Timeout limits how long a connection stays in the state, see
+// Machine.OnTimeout.
+//
+// A connection enters the initial state on its first command, or by
+// Machine.Current, which can be called in Handler.Serve to start the
+// timer on connecting.
+func Timeout[K comparable](d time.Duration) StateOpt[K] {
+	return func(sd *stateDef[K]) {
+		sd.timeout = d
+	}
+}
+
+// OnEnter sets the callback invoked after a connection entered the
+// state, including the initial one.
+func OnEnter[K comparable](fn func(w api.Response)) StateOpt[K] {
+	return func(sd *stateDef[K]) {
+		sd.onEnter = fn
+	}
+}
+
+// instance is the state of a connection.
+type instance struct {
+	state   State
+	timer   *time.Timer
+	dropped bool // the connection closed
+}
+
+// New makes a state machine starting from initial.
+func New[K comparable](initial State) *Machine[K] {
+	m := &Machine[K]{
+		initial:     initial,
+		states:      make(map[State]*stateDef[K]),
+		always:      make(map[K]bool),
+		transitions: make(map[State]map[K]State),
+		key:         net.NewSessionKey[*instance]("fsm"),
+	}
+	m.State(initial)
+	return m
+}
+
+// State declares a state, or adds the options to it.
+func (m *Machine[K]) State(name State, opts ...StateOpt[K]) {
+	sd, ok := m.states[name]
+	if !ok {
+		sd = &stateDef[K]{allowed: make(map[K]bool)}
+		m.states[name] = sd
+	}
+	for _, opt := range opts {
+		opt(sd)
+	}
+}
+
+// Always allows the commands in all states.
+func (m *Machine[K]) Always(keys ...K) {
+	for _, k := range keys {
+		m.always[k] = true
+	}
+}
+
+// Transition moves a connection from the state to another after the
+// command on was handled successfully. The command is allowed in the
+// state implicitly.
+func (m *Machine[K]) Transition(from State, on K, to State) {
+	m.State(from, Allow(on))
+	m.State(to)
+	if m.transitions[from] == nil {
+		m.transitions[from] = make(map[K]State)
+	}
+	m.transitions[from][on] = to
+}
+
+// OnReject sets the handler of the out-of-state commands. By default,
+// they are logged and skipped.
+func (m *Machine[K]) OnReject(h router.HandlerFunc[K]) { m.onReject = h }
+
+// OnTimeout sets the callback invoked after a connection stayed in a
+// state longer than its timeout. By default, the connection is closed.
+func (m *Machine[K]) OnTimeout(fn func(w api.Response, s State)) { m.onTimeout = fn }
+
+// Current returns the state of the connection.
+func (m *Machine[K]) Current(w api.Response) (s State) {
+	m.mu.Lock()
+	inst, created := m.instance(w)
+	s = inst.state
+	m.mu.Unlock()
+	if created {
+		m.entered(w, s)
+	}
+	return
+}
+
+// Set moves the connection to the state s.
+func (m *Machine[K]) Set(w api.Response, s State) {
+	m.mu.Lock()
+	inst, _ := m.instance(w)
+	m.enter(w, inst, s)
+	m.mu.Unlock()
+	m.entered(w, s)
+}
+
+// instance returns the state of w, and enters the initial state for
+// a new connection, then the caller should call entered after m.mu
+// released. It must be called with m.mu held.
+//
+// The state is kept in the session of the connection. Without one,
+// such as for udp packets, it is always the initial state.
+func (m *Machine[K]) instance(w api.Response) (inst *instance, created bool) {
+	sess := net.SessionOf(w)
+	if sess == nil {
+		return &instance{state: m.initial}, true
+	}
+	if inst, ok := m.key.Get(sess); ok {
+		return inst, false
+	}
+	inst = &instance{}
+	m.key.Set(sess, inst)
+	sess.OnClose(func(*net.Session) { go m.drop(inst) }) // m.mu is held
+	m.enter(w, inst, m.initial)
+	return inst, true
+}
+
+// enter switches inst to s, and restarts the timer. It must be called
+// with m.mu held.
+func (m *Machine[K]) enter(w api.Response, inst *instance, s State) {
+	if inst.timer != nil {
+		inst.timer.Stop()
+		inst.timer = nil
+	}
+	inst.state = s
+	if sd := m.states[s]; sd != nil && sd.timeout > 0 {
+		inst.timer = time.AfterFunc(sd.timeout, func() { m.expire(w, inst, s) })
+	}
+}
+
+func (m *Machine[K]) entered(w api.Response, s State) {
+	if sd := m.states[s]; sd != nil && sd.onEnter != nil {
+		sd.onEnter(w)
+	}
+}
+
+func (m *Machine[K]) expire(w api.Response, inst *instance, s State) {
+	m.mu.Lock()
+	expired := !inst.dropped && inst.state == s
+	m.mu.Unlock()
+	if !expired {
+		return
+	}
+	if m.onTimeout != nil {
+		m.onTimeout(w, s)
+		return
+	}
+	net.LoggerFromContext(net.ContextOf(w)).Debug("[fsm] state timed out, closing", "state", s)
+	w.Close()
+}
+
+func (m *Machine[K]) drop(inst *instance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inst.dropped = true
+	if inst.timer != nil {
+		inst.timer.Stop()
+	}
+}
+
+// Allowed tells whether the command is allowed in the state.
+func (m *Machine[K]) Allowed(s State, key K) bool {
+	if m.always[key] {
+		return true
+	}
+	sd := m.states[s]
+	return sd != nil && sd.allowed[key]
+}
+
+// Middleware rejects the commands not allowed in the current state,
+// and takes the transition after a command was handled.
+func (m *Machine[K]) Middleware() router.Middleware[K] {
+	return func(next router.HandlerFunc[K]) router.HandlerFunc[K] {
+		return func(ctx context.Context, msg *router.Message[K]) (err error) {
+			s := m.Current(msg.W)
+			if !m.Allowed(s, msg.Key) {
+				if m.onReject != nil {
+					return m.onReject(ctx, msg)
+				}
+				net.LoggerFromContext(ctx).Warn("[fsm] command rejected", "state", s, "key", msg.Key)
+				return nil
+			}
+
+			if err = next(ctx, msg); err != nil {
+				if errors.Is(err, ErrStay) {
+					err = nil
+				}
+				return
+			}
+			if to, ok := m.transitions[s][msg.Key]; ok {
+				m.mu.Lock()
+				inst, _ := m.instance(msg.W)
+				moved := inst.state == s // not moved by the handler
+				if moved {
+					m.enter(msg.W, inst, to)
+				}
+				m.mu.Unlock()
+				if moved {
+					m.entered(msg.W, to)
+				}
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package fsm
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net"
+	"github.com/hedzr/go-socketlib/net/router"
+)
+
+func newTestRouter(timeout time.Duration) *router.Router[string] {
+	m := New[string]("authorization")
+	m.State("authorization", Allow("user"), Timeout[string](timeout))
+	m.State("transaction", Allow("stat"))
+	m.Always("quit")
+	m.Transition("authorization", "pass", "transaction")
+	m.OnReject(func(ctx context.Context, msg *router.Message[string]) (err error) {
+		_, err = msg.W.Write([]byte("-ERR " + msg.Key + " not allowed in " + string(m.Current(msg.W)) + "\n"))
+		return
+	})
+
+	reply := func(ctx context.Context, msg *router.Message[string]) (err error) {
+		_, err = msg.W.Write([]byte("+OK " + msg.Key + "\n"))
+		return
+	}
+	r := router.New(router.FirstWord())
+	r.Use(m.Middleware())
+	r.Handle("user", reply)
+	r.Handle("stat", reply)
+	r.Handle("quit", reply)
+	r.Handle("pass", func(ctx context.Context, msg *router.Message[string]) (err error) {
+		if string(msg.Payload) != "secret" {
+			_, _ = msg.W.Write([]byte("-ERR bad password\n"))
+			return ErrStay
+		}
+		return reply(ctx, msg)
+	})
+	return r
+}
+
+func TestMachine(t *testing.T) {
+	addr := startServer(t, net.WithServerHandler(newTestRouter(time.Minute)))
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	scanner := bufio.NewScanner(conn)
+	for _, c := range []struct{ send, expect string }{
+		{"stat", "-ERR stat not allowed in authorization"},
+		{"user bob", "+OK user"},
+		{"pass wrong", "-ERR bad password"},
+		{"pass secret", "+OK pass"},
+		{"user bob", "-ERR user not allowed in transaction"},
+		{"stat", "+OK stat"},
+		{"quit", "+OK quit"},
+	} {
+		if _, err = conn.Write([]byte(c.send + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		if !scanner.Scan() {
+			t.Fatal(scanner.Err())
+		}
+		if scanner.Text() != c.expect {
+			t.Fatalf("%q: expect %q, but got %q", c.send, c.expect, scanner.Text())
+		}
+	}
+}
+
+func TestMachine_timeout(t *testing.T) {
+	addr := startServer(t, net.WithServerHandler(newTestRouter(50*time.Millisecond)))
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err = conn.Write([]byte("user bob\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	// closed after staying in authorization too long
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "+OK user\n" {
+		t.Fatalf("expect the reply then EOF, but got %q", data)
+	}
+}
+
+func startServer(t *testing.T, opts ...net.ServerOpt) (addr string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := net.NewServer("127.0.0.1:0", append([]net.ServerOpt{
+		net.WithServerQuiet(true),
+		net.WithServerLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		net.WithServerOnListening(func(ss net.Server, l stdnet.Listener) { addr = l.Addr().String() }),
+	}, opts...)...)
+	if err := s.Start(ctx); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		_ = s.Stop()
+	})
+	return
+}
@@ -0,0 +1,171 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// the half-close states of a connection
+const (
+	halfRead   int32 = 1 << iota // the reading side was shut down by CloseRead
+	halfWrite                    // the writing side was shut down by CloseWrite
+	halfEOF                      // the peer finished sending
+	halfSealed                   // the messages cached before CloseWrite were written, the later ones are rejected
+)
+
+type halfState struct{ v int32 }
+
+// set adds the bits, and returns the previous state.
+func (h *halfState) set(bits int32) (old int32) {
+	for {
+		if old = atomic.LoadInt32(&h.v); atomic.CompareAndSwapInt32(&h.v, old, old|bits) {
+			return
+		}
+	}
+}
+
+func (h *halfState) has(bits int32) bool { return atomic.LoadInt32(&h.v)&bits != 0 }
+
+// shutdownConn shuts down one side of conn. Shutting down the writing
+// side of a tls connection only sends close_notify, the writing side
+// of the underlying connection is kept open.
+func shutdownConn(conn net.Conn, side int32) error {
+	conn = baseConn(conn)
+	if side == halfWrite {
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			return c.CloseWrite()
+		}
+		return api.ErrHalfCloseUnsupported
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+	return api.ErrHalfCloseUnsupported
+}
+
+// CloseWrite writes the cached messages, and shuts down the writing
+// side, see api.HalfCloser. The connection is closed if the reading
+// side ended too.
+func (s *connS) CloseWrite() (err error) {
+	if s.Closed() {
+		return net.ErrClosed
+	}
+	if s.half.set(halfWrite)&halfWrite != 0 {
+		return
+	}
+	s.hj.mu.Lock()
+	looping := s.hj.looping
+	s.hj.mu.Unlock()
+	if err = s.flushQueued(s.connCtx(), looping, func() { s.half.set(halfSealed) }); err == nil {
+		err = s.shutdown(halfWrite)
+	}
+	if err != nil || s.half.has(halfRead|halfEOF) {
+		s.Close()
+	}
+	return
+}
+
+// CloseRead shuts down the reading side, see api.HalfCloser. The
+// connection is kept till CloseWrite or Close.
+func (s *connS) CloseRead() (err error) {
+	if s.Closed() {
+		return net.ErrClosed
+	}
+	s.half.set(halfRead)
+	if err = s.shutdown(halfRead); err != nil || s.half.has(halfWrite) {
+		s.Close()
+	}
+	return
+}
+
+func (s *connS) shutdown(side int32) error {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	conn := s.conn.Load()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	return shutdownConn(conn, side)
+}
+
+// readEnded is called after the reading side got EOF. Unless
+// CloseRead was called, the connection is closed once the data
+// received was processed and the cached messages were written.
+func (s *connS) readEnded() {
+	if s.half.set(halfEOF)&halfRead != 0 {
+		return
+	}
+	if atomic.LoadInt64(&s.busy) == 0 {
+		s.finishRead()
+	}
+}
+
+// processed is called by the worker pool after a chunk of data was
+// processed.
+func (s *connS) processed() {
+	if atomic.AddInt64(&s.busy, -1) == 0 && s.half.has(halfEOF) && !s.half.has(halfRead) {
+		s.finishRead()
+	}
+}
+
+func (s *connS) finishRead() {
+	if !atomic.CompareAndSwapInt32(&s.finishing, 0, 1) {
+		return
+	}
+	s.hj.mu.Lock()
+	looping := s.hj.looping
+	s.hj.mu.Unlock()
+	go func() {
+		defer s.recoverPanic("finishRead")
+		ctx, cancel := context.WithTimeout(s.connCtx(), s.writeTimeout)
+		defer cancel()
+		if err := s.flushQueued(ctx, looping, nil); err != nil {
+			s.Debug("[connS] cannot flush the cached messages after EOF", "err", err)
+		}
+		s.Close()
+	}()
+}
+
+// CloseWrite writes the cached messages, and shuts down the writing
+// side, see api.HalfCloser.
+func (c *clientS) CloseWrite() (err error) {
+	if c.Closed() {
+		return net.ErrClosed
+	}
+	if c.half.set(halfWrite)&halfWrite != 0 {
+		return
+	}
+	c.hj.mu.Lock()
+	looping := c.hj.looping
+	c.hj.mu.Unlock()
+	if err = c.flushQueued(c.connCtx(), looping, func() { c.half.set(halfSealed) }); err == nil {
+		err = c.shutdown(halfWrite)
+	}
+	return
+}
+
+// CloseRead shuts down the reading side, see api.HalfCloser.
+func (c *clientS) CloseRead() (err error) {
+	if c.Closed() {
+		return net.ErrClosed
+	}
+	c.half.set(halfRead)
+	return c.shutdown(halfRead)
+}
+
+func (c *clientS) shutdown(side int32) error {
+	c.wl.Lock()
+	defer c.wl.Unlock()
+	conn := c.conn.Load()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	return shutdownConn(conn, side)
+}
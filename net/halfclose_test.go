@@ -0,0 +1,178 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// slowLineProcessor replies each line after a while, and shuts down
+// the writing side after "bye".
+func slowLineProcessor(got chan<- string) OnTcpServerProcessData {
+	return func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+		for err == nil {
+			i := bytes.IndexByte(data[nn:], '\n')
+			if i < 0 {
+				break
+			}
+			line := string(data[nn : nn+i])
+			nn += i + 1
+			got <- line
+			time.Sleep(20 * time.Millisecond)
+			if _, err = w.Write([]byte(line + "!\n")); err == nil && line == "bye" {
+				err = w.(api.HalfCloser).CloseWrite()
+			}
+		}
+		if nn == 0 && err == nil {
+			err = ErrIncompleteFrame
+		}
+		return
+	}
+}
+
+func TestServer_halfClosedByPeer(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		opts []ServerOpt
+	}{
+		{"goroutine", nil},
+		{"reactor", []ServerOpt{WithServerReactor(1)}},
+		{"worker pool", []ServerOpt{WithServerWorkerPool(2, 16, WorkerPoolOrdered)}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			addr, _ := startTestServer(t, append(c.opts, WithServerOnProcessData(slowLineProcessor(make(chan string, 8))))...)
+			conn, scanner := dialLines(t, addr)
+			_, _ = conn.Write([]byte("a\nb\nc\n"))
+			if err := conn.(*stdnet.TCPConn).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			expectLines(t, scanner, "a!", "b!", "c!") // replied after EOF
+			if scanner.Scan() {
+				t.Fatalf("expect the connection closed, but got %q", scanner.Text())
+			}
+		})
+	}
+}
+
+func TestServer_closeWrite(t *testing.T) {
+	got := make(chan string, 8)
+	addr, _ := startTestServer(t, WithServerOnProcessData(slowLineProcessor(got)))
+	conn, scanner := dialLines(t, addr)
+	_, _ = conn.Write([]byte("bye\n"))
+	expectLines(t, scanner, "bye!")
+	if scanner.Scan() {
+		t.Fatalf("expect EOF, but got %q", scanner.Text())
+	}
+
+	_, _ = conn.Write([]byte("more\n")) // still read by the server
+	for _, expect := range []string{"bye", "more"} {
+		select {
+		case line := <-got:
+			if line != expect {
+				t.Fatalf("expect %q, but got %q", expect, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", expect)
+		}
+	}
+}
+
+func TestClient_closeWrite(t *testing.T) {
+	addr, _ := startTestServer(t, WithServerOnProcessData(slowLineProcessor(make(chan string, 8))))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lc := &lineCollector{lines: make(chan string, 8)}
+	c := NewClient(WithClientLogger(testLogger()), WithClientInterceptor(lc))
+	if err := c.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Run(ctx)
+
+	if _, err := c.Write([]byte("a\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("b\n")); !errors.Is(err, api.ErrWriteClosed) {
+		t.Fatalf("expect ErrWriteClosed, but got %v", err)
+	}
+	select {
+	case line := <-lc.lines:
+		if line != "a!\n" {
+			t.Fatalf("expect %q, but got %q", "a!\n", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the reply")
+	}
+}
+
+func TestClient_closeWriteQueuedBehind(t *testing.T) {
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn) // till the writing side of the client shut down
+		received <- string(b)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hw := &holdWriter{held: make(chan struct{}), release: make(chan struct{})}
+	c := NewClient(WithClientLogger(testLogger()), WithClientInterceptor(hw))
+	if err = c.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Run(ctx)
+
+	if _, err = c.Write([]byte("hold\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-hw.held
+	closed := make(chan error, 1)
+	go func() { closed <- c.CloseWrite() }()
+	for c.wq.Len() == 0 { // the barrier of CloseWrite
+		time.Sleep(time.Millisecond)
+	}
+	late := newWriteReq([]byte("late\n"), true, nil)
+	if _, err = c.wq.push(ctx, late); err != nil { // passed the check of enqueue before CloseWrite
+		t.Fatal(err)
+	}
+	close(hw.release)
+
+	if err = <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if _, err = late.Wait(ctx); !errors.Is(err, api.ErrWriteClosed) {
+		t.Fatalf("expect the message behind CloseWrite rejected, but got %v", err)
+	}
+	if c.Closed() {
+		t.Fatal("expect the client kept open")
+	}
+	select {
+	case got := <-received:
+		if got != "hold\n" {
+			t.Fatalf("expect %q, but got %q", "hold\n", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for EOF")
+	}
+}
@@ -0,0 +1,239 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+var errHijackUnsupported = errors.New("hijacking unsupported in reactor or worker pool mode")
+
+// hijackState coordinates Hijack with the reading and writing loops
+// of a connection.
+type hijackState struct {
+	mu        sync.Mutex
+	hijacked  int32
+	looping   bool          // the loops have been started
+	stop      chan struct{} // closed on hijacking to stop the loops
+	readDone  chan struct{}
+	writeDone chan struct{}
+	inProcess int32  // 1 while the reading loop is processing data
+	buffered  []byte // the unprocessed bytes handed back by the reading loop
+}
+
+// startLoops returns false if the connection has been hijacked, so
+// the loops should not be started.
+func (h *hijackState) startLoops() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.hijacked != 0 {
+		return false
+	}
+	h.looping = true
+	h.stop = make(chan struct{})
+	h.readDone = make(chan struct{})
+	h.writeDone = make(chan struct{})
+	return true
+}
+
+// begin marks the connection hijacked and signals the loops to stop.
+// It returns whether the loops have been started.
+func (h *hijackState) begin() (looping bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.hijacked != 0 {
+		return false, api.ErrHijacked
+	}
+	atomic.StoreInt32(&h.hijacked, 1)
+	if h.looping {
+		close(h.stop)
+	}
+	return h.looping, nil
+}
+
+func (h *hijackState) isHijacked() bool { return atomic.LoadInt32(&h.hijacked) != 0 }
+
+// wait wakes the reading loop up by a past read deadline, and waits
+// for the loops stopped. The reading loop is not waited if Hijack is
+// called while processing data, which is on the reading loop.
+func (h *hijackState) wait(conn net.Conn) {
+	_ = conn.SetReadDeadline(aLongTimeAgo)
+	if atomic.LoadInt32(&h.inProcess) == 0 {
+		<-h.readDone
+	}
+	<-h.writeDone
+	_ = conn.SetReadDeadline(time.Time{})
+}
+
+// waitWriter waits for the writing loop stopped, if it was started.
+func (h *hijackState) waitWriter() {
+	h.mu.Lock()
+	looping, done := h.looping, h.writeDone
+	h.mu.Unlock()
+	if looping {
+		<-done
+	}
+}
+
+// handBack keeps a copy of the unprocessed bytes for Hijack.
+func (h *hijackState) handBack(pending []byte) {
+	if len(pending) > 0 {
+		h.buffered = append([]byte(nil), pending...)
+	}
+}
+
+// flushPending writes the cached messages without waiting for more.
+func (s *connS) flushPending(ctx context.Context) {
+	for {
+		select {
+		case req := <-s.wq.ch:
+			if err := writeBatch(ctx, s.protocolInterceptor, s, s.wq.drain(req, s.wbSize, 0), s.rawWriteBuffers); err != nil {
+				s.handleError(err, "[connS] Write failed")
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// flushQueued writes the cached messages before returning, by a
+// barrier request if the writing loop is running. then, if not nil,
+// is called once the messages before the barrier were written, and
+// before any later one is.
+func (s *connS) flushQueued(ctx context.Context, looping bool, then func()) (err error) {
+	if looping || s.inReactor() {
+		var cb func(int, error)
+		if then != nil {
+			cb = func(int, error) { then() }
+		}
+		barrier := newWriteReq(nil, true, cb)
+		if err = s.enqueue(ctx, barrier); err == nil {
+			_, err = barrier.Wait(ctx)
+		}
+		return
+	}
+	s.flushPending(ctx)
+	if then != nil {
+		then()
+	}
+	return
+}
+
+// Hijack stops the internal reading and writing loops, and hands the
+// underlying net.Conn over to the caller, see api.Hijacker.
+//
+// The cached messages are flushed before returning. Hijacking is
+// unsupported after the connection detached to the reactor or with a
+// worker pool, unless it is called in Handler.Serve.
+func (s *connS) Hijack() (conn net.Conn, buffered []byte, err error) {
+	if conn = s.conn.Load(); conn == nil || s.Closed() {
+		return nil, nil, net.ErrClosed
+	}
+	s.hj.mu.Lock()
+	unsupported := s.hj.looping && s.pool != nil || s.inReactor()
+	s.hj.mu.Unlock()
+	if unsupported {
+		return nil, nil, errHijackUnsupported
+	}
+
+	var looping bool
+	if looping, err = s.hj.begin(); err != nil {
+		return nil, nil, err
+	}
+	if looping {
+		s.hj.wait(conn)
+	} else {
+		s.flushPending(s.connCtx())
+	}
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil, nil, net.ErrClosed
+	}
+	s.wq.close()
+	s.wq.discard(api.ErrHijacked)
+	if s.cancel != nil {
+		s.cancel(api.ErrHijacked)
+	}
+	if s.rs != nil {
+		s.resumer.drop(s.rs) // the caller owns the connection now
+		if rc, ok := conn.(*resumeConn); ok {
+			conn = rc.Conn
+		}
+	} else {
+		s.sess.close()
+	}
+	s.Debug("[connS] hijacked", "buffered", len(s.hj.buffered))
+	return conn, s.hj.buffered, nil
+}
+
+// flushPending writes the cached messages without waiting for more.
+func (c *clientS) flushPending(ctx context.Context) {
+	for {
+		select {
+		case req := <-c.wq.ch:
+			if err := writeBatch(ctx, c.protocolInterceptor, c, c.wq.drain(req, c.wbSize, 0), c.rawWriteBuffers); err != nil {
+				c.Error("[client] Write failed", "err", err)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// flushQueued writes the cached messages before returning, by a
+// barrier request if the writing loop is running. then, if not nil,
+// is called once the messages before the barrier were written, and
+// before any later one is.
+func (c *clientS) flushQueued(ctx context.Context, looping bool, then func()) (err error) {
+	if looping {
+		var cb func(int, error)
+		if then != nil {
+			cb = func(int, error) { then() }
+		}
+		barrier := newWriteReq(nil, true, cb)
+		if err = c.enqueue(ctx, barrier); err == nil {
+			_, err = barrier.Wait(ctx)
+		}
+		return
+	}
+	c.flushPending(ctx)
+	if then != nil {
+		then()
+	}
+	return
+}
+
+// Hijack stops the internal reading and writing loops, and hands the
+// underlying net.Conn over to the caller, see api.Hijacker.
+//
+// The cached messages are flushed before returning. The bytes read
+// are handed to the interceptor already, so buffered is nil unless
+// a read failed with some bytes while hijacking.
+func (c *clientS) Hijack() (conn net.Conn, buffered []byte, err error) {
+	if conn = c.conn.Load(); conn == nil || c.Closed() {
+		return nil, nil, net.ErrClosed
+	}
+
+	var looping bool
+	if looping, err = c.hj.begin(); err != nil {
+		return nil, nil, err
+	}
+	if looping {
+		c.hj.wait(conn)
+	} else {
+		c.flushPending(c.connCtx())
+	}
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil, nil, net.ErrClosed
+	}
+	c.wq.close()
+	c.wq.discard(api.ErrHijacked)
+	c.Debug("[client] hijacked")
+	return conn, c.hj.buffered, nil
+}
@@ -0,0 +1,115 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// rawEcho echoes the lines of a hijacked connection with a prefix.
+func rawEcho(conn stdnet.Conn, buffered []byte) {
+	defer conn.Close()
+	if len(buffered) > 0 {
+		_, _ = conn.Write(append([]byte("raw:"), buffered...))
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		_, _ = conn.Write([]byte("raw:" + scanner.Text() + "\n"))
+	}
+}
+
+func TestServer_hijack(t *testing.T) {
+	addr, _ := startTestServer(t,
+		WithServerOnProcessData(func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+			nn = len(data)
+			if string(data) != "STARTTLS\n" {
+				_, err = w.Write(append([]byte(nil), data...))
+				return
+			}
+			if _, err = w.Write([]byte("OK\n")); err != nil {
+				return
+			}
+			conn, buffered, err := w.(api.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			go rawEcho(conn, buffered)
+			return
+		}),
+	)
+
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+
+	for _, c := range []struct{ send, expect string }{
+		{"hello\n", "hello"},
+		{"STARTTLS\n", "OK"},
+		{"hello\n", "raw:hello"},
+		{"world\n", "raw:world"},
+	} {
+		if _, err = conn.Write([]byte(c.send)); err != nil {
+			t.Fatal(err)
+		}
+		if !scanner.Scan() {
+			t.Fatal(scanner.Err())
+		}
+		if scanner.Text() != c.expect {
+			t.Fatalf("expect %q, but got %q", c.expect, scanner.Text())
+		}
+	}
+}
+
+func TestClient_hijack(t *testing.T) {
+	received := make(chan string, 4)
+	addr, _ := startTestServer(t, WithServerOnProcessData(func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+		received <- string(data)
+		return echoProcessor(data, w, r)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewClient(WithClientLogger(testLogger()))
+	if err := c.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	c.Run(ctx)
+	if _, err := c.Write([]byte("queued\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _, err := c.Hijack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, err = c.Hijack(); err == nil {
+		t.Fatal("expect hijacking twice failed")
+	}
+
+	// the queued message was flushed before hijacking
+	if got := <-received; got != "queued\n" {
+		t.Fatalf("expect the queued message, but got %q", got)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("direct\n")); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() && scanner.Text() == "queued" {
+		// the echo of queued message may be read by the client loop
+	}
+	if scanner.Text() != "direct" {
+		t.Fatalf("expect %q, but got %q, %v", "direct", scanner.Text(), scanner.Err())
+	}
+}
@@ -0,0 +1,27 @@
+package net
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var errNotIPConn = errors.New("not a raw IP connection")
+
+// isIPNetwork tells whether network is a raw IP one, such as
+// "ip4:icmp".
+func isIPNetwork(network string) bool {
+	return strings.HasPrefix(network, "ip:") || strings.HasPrefix(network, "ip4:") || strings.HasPrefix(network, "ip6:")
+}
+
+// ipConn is a connected raw IP socket of a client. The reading of
+// net.IPConn returns the IPv4 header too, while ReadFrom strips it,
+// so that the interceptor receives the payload only.
+type ipConn struct {
+	*net.IPConn
+}
+
+func (c *ipConn) Read(p []byte) (n int, err error) {
+	n, _, err = c.IPConn.ReadFrom(p)
+	return
+}
@@ -0,0 +1,155 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	stdnet "net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// icmpEcho builds an ICMP echo message of typ with the checksum.
+func icmpEcho(typ byte, rest, payload []byte) []byte {
+	msg := append(append([]byte{typ, 0, 0, 0}, rest...), payload...)
+	var sum uint32
+	for i := 0; i < len(msg); i += 2 {
+		sum += uint32(msg[i]) << 8
+		if i+1 < len(msg) {
+			sum += uint32(msg[i+1])
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	msg[2], msg[3] = ^byte(sum>>8), ^byte(sum)
+	return msg
+}
+
+func TestServer_rawIP(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("raw ip sockets need the administrator privileges on windows")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	got := make(chan string, 4)
+	s := NewServer("127.0.0.1",
+		WithNetwork("ip4:icmp"),
+		WithServerQuiet(true),
+		WithServerLogger(testLogger()),
+		WithServerOnProcessData(func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+			if len(data) >= 8 && data[0] == 8 { // echo request, replied by "re:" + payload
+				got <- w.RemoteAddr().String() + " " + string(data[8:])
+				_, err = w.Write(icmpEcho(0, data[4:8], append([]byte("re:"), data[8:]...)))
+			}
+			return len(data), err
+		}),
+	)
+	if err := s.Start(ctx); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			t.Skip("raw ip sockets are not permitted:", err)
+		}
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	lc := &lineCollector{lines: make(chan string, 16)}
+	c := NewClient(WithClientLogger(testLogger()), WithClientInterceptor(lc))
+	if err := c.Dial("ip4:icmp", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Run(ctx)
+
+	if _, err := c.Write(icmpEcho(8, []byte{0x12, 0x34, 0, 1}, []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case line := <-got:
+		if line != "127.0.0.1 hello" {
+			t.Fatalf("unexpected request %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the request")
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-lc.lines: // the client sees the request and the reply of kernel too
+			if msg[0] == 0 && msg[8:] == "re:hello" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for the reply")
+		}
+	}
+}
+
+// TestServer_rawIPHeaders checks the raw IP sockets of Listen and Dial
+// strip the IPv4 headers, and give the source *net.IPAddr.
+func TestServer_rawIPHeaders(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("raw ip sockets need the administrator privileges on windows")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	got := make(chan string, 4)
+	s := NewServer("127.0.0.1",
+		WithNetwork("ip4:icmp"),
+		WithServerQuiet(true),
+		WithServerLogger(testLogger()),
+		WithServerOnProcessData(func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+			if _, ok := w.RemoteAddr().(*stdnet.IPAddr); ok && len(data) > 0 {
+				got <- fmt.Sprintf("%#x %q", data[0], data[min(8, len(data)):])
+			}
+			return len(data), nil
+		}),
+	)
+	if err := s.Start(ctx); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			t.Skip("raw ip sockets are not permitted, CAP_NET_RAW needed:", err)
+		}
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c := NewClient(WithClientLogger(testLogger()))
+	if err := c.Dial("ip4:icmp", "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.conn.Load().(*ipConn); !ok {
+		t.Fatalf("expect the client reading by ipConn, but got %T", c.conn.Load())
+	}
+	buf := make([]byte, 512)
+	read := make(chan string, 4)
+	go func() { // the client sees the request and the reply of kernel
+		for {
+			n, err := c.conn.Load().Read(buf)
+			if err != nil {
+				return
+			}
+			read <- fmt.Sprintf("%#x %q", buf[0], buf[min(8, n):n])
+		}
+	}()
+
+	if _, err := c.conn.Load().Write(icmpEcho(8, []byte{0x12, 0x34, 0, 2}, []byte("headers"))); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []chan string{got, read} { // the type of ICMP comes first, no IPv4 header (0x45)
+		select {
+		case line := <-ch:
+			if line != `0x8 "headers"` && line != `0x0 "headers"` {
+				t.Fatalf("unexpected message %s", line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the message")
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package net
+
+import (
+	"context"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// Middleware wraps a Handler to add the cross-cutting behaviors,
+// like net/http middlewares.
+//
+// A middleware built by NewMiddleware wraps the per-message
+// OnProcessData path too, see ProcessWrapper.
+type Middleware func(next Handler) Handler
+
+// Chain composes the middlewares. The first one is the outermost,
+// so Chain(a, b)(h) equals to a(b(h)).
+func Chain(mws ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(mws) - 1; i >= 0; i-- {
+			if mws[i] != nil {
+				h = mws[i](h)
+			}
+		}
+		return h
+	}
+}
+
+// WithServerMiddlewares wraps the server Handler by the middlewares,
+// in order: the first one is the outermost.
+//
+// The middlewares are applied after all options, so the order of
+// WithServerHandler doesn't matter. Without a Handler, they wrap the
+// default serving routine and the OnProcessData callback.
+func WithServerMiddlewares(mws ...Middleware) ServerOpt {
+	return func(s *serverWrap) {
+		s.middlewares = append(s.middlewares, mws...)
+	}
+}
+
+// ProcessWrapper is implemented by a Handler which wraps the
+// per-message data processor. base is the processor resolved from
+// the server options, the default one, or the inner handler.
+type ProcessWrapper interface {
+	WrapProcess(base OnTcpServerProcessData) OnTcpServerProcessData
+}
+
+// NewMiddleware builds a Middleware from two wrapping functions, the
+// per-connection serve and the per-message process. Either of them
+// can be nil.
+//
+// process is called once for each connection while resolving its
+// data processor, so the returned function can hold the state of
+// the connection. For udp servers it is called once for the packet
+// loop.
+func NewMiddleware(serve func(next HandlerFunc) HandlerFunc, process func(next OnTcpServerProcessData) OnTcpServerProcessData) Middleware {
+	return func(next Handler) Handler {
+		return &mwHandler{next: next, serve: serve, process: process}
+	}
+}
+
+type mwHandler struct {
+	next    Handler
+	serve   func(next HandlerFunc) HandlerFunc
+	process func(next OnTcpServerProcessData) OnTcpServerProcessData
+}
+
+func (m *mwHandler) Serve(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+	next := HandlerFunc(func(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+		if m.next == nil {
+			return
+		}
+		return m.next.Serve(ctx, w, r)
+	})
+	if m.serve != nil {
+		return m.serve(next)(ctx, w, r)
+	}
+	return next(ctx, w, r)
+}
+
+func (m *mwHandler) WrapProcess(base OnTcpServerProcessData) (process OnTcpServerProcessData) {
+	process = base
+	switch z := m.next.(type) {
+	case ProcessWrapper:
+		process = z.WrapProcess(base)
+	case DataProcessor:
+		process = z.Process
+	}
+	if m.process != nil {
+		process = m.process(process)
+	}
+	return
+}
+
+// corruptDataFinder looks up the CorruptDataFinder through the
+// middlewares.
+func corruptDataFinder(h Handler) (z CorruptDataFinder, ok bool) {
+	for h != nil {
+		if z, ok = h.(CorruptDataFinder); ok {
+			return
+		}
+		m, isMw := h.(*mwHandler)
+		if !isMw {
+			break
+		}
+		h = m.next
+	}
+	return
+}
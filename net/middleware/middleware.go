@@ -0,0 +1,218 @@
+// Package middleware provides the reusable net.Middleware for
+// cross-cutting concerns: panic recovery, logging, metrics,
+// authentication and rate limiting.
+//
+// Compose them by net.Chain, the first one is the outermost:
+//
+//	mw := net.Chain(
+//		middleware.Recovery(),
+//		middleware.Logging(logger),
+//		metrics.Middleware(),
+//		middleware.Auth(check),
+//		middleware.RateLimit(100, 10),
+//	)
+//	server := net.NewServer(addr, net.WithServerMiddlewares(mw))
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net"
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// Recovery converts a panic in the inner handler or data processor
+// into a *net.PanicError, so that only the connection is closed.
+//
+// The server recovers the panics of connection goroutines anyway.
+// Recovery lets the outer middlewares see the panics as errors.
+func Recovery() net.Middleware {
+	return net.NewMiddleware(
+		func(next net.HandlerFunc) net.HandlerFunc {
+			return func(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+				defer func() {
+					if v := recover(); v != nil {
+						processed, err = true, &net.PanicError{Value: v, Stack: debug.Stack(), Where: "serve"}
+						w.Close()
+					}
+				}()
+				return next(ctx, w, r)
+			}
+		},
+		func(next net.OnTcpServerProcessData) net.OnTcpServerProcessData {
+			return func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+				defer func() {
+					if v := recover(); v != nil {
+						nn, err = len(data), &net.PanicError{Value: v, Stack: debug.Stack(), Where: "process"}
+					}
+				}()
+				return next(data, w, r)
+			}
+		},
+	)
+}
+
+// Logging logs the incoming connections and the processed messages
+// at debug level, and the failures at warning level.
+func Logging(logger *slog.Logger) net.Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return net.NewMiddleware(
+		func(next net.HandlerFunc) net.HandlerFunc {
+			return func(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+				logger.Debug("[middleware] connection accepted", "client.addr", w.RemoteAddrString())
+				if processed, err = next(ctx, w, r); err != nil {
+					logger.Warn("[middleware] connection serving failed", "client.addr", w.RemoteAddrString(), "err", err)
+				}
+				return
+			}
+		},
+		func(next net.OnTcpServerProcessData) net.OnTcpServerProcessData {
+			return func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+				start := time.Now()
+				nn, err = next(data, w, r)
+				if err != nil {
+					logger.Warn("[middleware] processing failed", "client.addr", w.RemoteAddrString(), "data-len", len(data), "err", err)
+				} else {
+					logger.Debug("[middleware] processed", "client.addr", w.RemoteAddrString(), "data-len", len(data), "nn", nn, "elapsed", time.Since(start))
+				}
+				return
+			}
+		},
+	)
+}
+
+// Metrics counts the connections, the processed messages and bytes,
+// and the failures.
+type Metrics struct {
+	connections int64
+	messages    int64
+	bytes       int64
+	errors      int64
+}
+
+// MetricsSnapshot is a copy of the counters of Metrics.
+type MetricsSnapshot struct {
+	Connections int64 // the accepted connections
+	Messages    int64 // the calls of data processor
+	Bytes       int64 // the bytes consumed by data processor
+	Errors      int64 // the failures of handler and data processor
+}
+
+// Snapshot returns the current counters.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		Connections: atomic.LoadInt64(&m.connections),
+		Messages:    atomic.LoadInt64(&m.messages),
+		Bytes:       atomic.LoadInt64(&m.bytes),
+		Errors:      atomic.LoadInt64(&m.errors),
+	}
+}
+
+// Middleware returns the middleware which updates m.
+func (m *Metrics) Middleware() net.Middleware {
+	return net.NewMiddleware(
+		func(next net.HandlerFunc) net.HandlerFunc {
+			return func(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+				atomic.AddInt64(&m.connections, 1)
+				if processed, err = next(ctx, w, r); err != nil {
+					atomic.AddInt64(&m.errors, 1)
+				}
+				return
+			}
+		},
+		func(next net.OnTcpServerProcessData) net.OnTcpServerProcessData {
+			return func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+				nn, err = next(data, w, r)
+				atomic.AddInt64(&m.messages, 1)
+				if nn > 0 {
+					atomic.AddInt64(&m.bytes, int64(nn))
+				}
+				if err != nil {
+					atomic.AddInt64(&m.errors, 1)
+				}
+				return
+			}
+		},
+	)
+}
+
+// ErrUnauthorized can be returned by an Auth checker.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Auth checks each incoming connection before the inner handler. The
+// connection is closed if check returns an error.
+//
+// check may read the credentials from r, and write a reply to w.
+func Auth(check func(ctx context.Context, w api.Response, r api.Request) error) net.Middleware {
+	return net.NewMiddleware(
+		func(next net.HandlerFunc) net.HandlerFunc {
+			return func(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+				if err = check(ctx, w, r); err != nil {
+					w.Close()
+					return true, err
+				}
+				return next(ctx, w, r)
+			}
+		},
+		nil,
+	)
+}
+
+// RateLimit limits the calls of data processor of each connection by
+// a token bucket, which refills perSecond tokens per second and holds
+// burst tokens at most. The processing waits for a token, so the
+// reading of the connection slows down.
+//
+// For udp servers the limit is shared by all peers.
+func RateLimit(perSecond float64, burst int) net.Middleware {
+	return net.NewMiddleware(nil,
+		func(next net.OnTcpServerProcessData) net.OnTcpServerProcessData {
+			b := newBucket(perSecond, burst)
+			return func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+				if d := b.take(time.Now()); d > 0 {
+					time.Sleep(d)
+				}
+				return next(data, w, r)
+			}
+		},
+	)
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(perSecond float64, burst int) *bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &bucket{rate: perSecond, burst: float64(burst), tokens: float64(burst)}
+}
+
+// take takes a token, and returns how long to wait for it.
+func (b *bucket) take(now time.Time) (wait time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens < 0 && b.rate > 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	return
+}
@@ -0,0 +1,178 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net"
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func TestBucket(t *testing.T) {
+	b := newBucket(10, 2)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if d := b.take(now); d != 0 {
+			t.Fatalf("take %d: expect no wait in burst, but got %v", i, d)
+		}
+	}
+	if d := b.take(now); d != 100*time.Millisecond {
+		t.Fatalf("expect waiting 100ms, but got %v", d)
+	}
+	if d := b.take(now.Add(time.Second)); d != 0 {
+		t.Fatalf("expect no wait after refilled, but got %v", d)
+	}
+}
+
+type fakeConn struct {
+	closed bool
+	out    bytes.Buffer
+}
+
+func (c *fakeConn) Close() { c.closed = true }
+func (c *fakeConn) LocalAddr() stdnet.Addr {
+	return &stdnet.TCPAddr{IP: stdnet.IPv4(127, 0, 0, 1), Port: 1}
+}
+func (c *fakeConn) RemoteAddr() stdnet.Addr {
+	return &stdnet.TCPAddr{IP: stdnet.IPv4(127, 0, 0, 1), Port: 2}
+}
+func (c *fakeConn) RemoteAddrString() string    { return c.RemoteAddr().String() }
+func (c *fakeConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (c *fakeConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+// wrap applies mw to a handler and a data processor.
+func wrap(mw net.Middleware, serve net.HandlerFunc, process net.OnTcpServerProcessData) (net.Handler, net.OnTcpServerProcessData) {
+	h := mw(serve)
+	return h, h.(net.ProcessWrapper).WrapProcess(process)
+}
+
+func TestRecovery(t *testing.T) {
+	h, process := wrap(Recovery(),
+		func(ctx context.Context, w api.Response, r api.Request) (bool, error) { panic("serve") },
+		func(data []byte, w api.Response, r api.Request) (int, error) { panic("process") },
+	)
+
+	c := &fakeConn{}
+	processed, err := h.Serve(context.Background(), c, c)
+	var pe *net.PanicError
+	if !processed || !errors.As(err, &pe) || pe.Where != "serve" || pe.Value != "serve" {
+		t.Fatalf("expect a serve panic error, but got %v, %v", processed, err)
+	}
+	if !c.closed {
+		t.Fatal("expect the connection closed after a serve panic")
+	}
+
+	c = &fakeConn{}
+	nn, err := process([]byte("abc"), c, c)
+	if nn != 3 || !errors.As(err, &pe) || pe.Where != "process" || pe.Value != "process" {
+		t.Fatalf("expect a process panic error consuming the data, but got %d, %v", nn, err)
+	}
+	if c.closed {
+		t.Fatal("expect the connection left to the server after a process panic")
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	fail := errors.New("bad frame")
+	h, process := wrap(Logging(logger),
+		func(ctx context.Context, w api.Response, r api.Request) (bool, error) { return false, nil },
+		func(data []byte, w api.Response, r api.Request) (int, error) {
+			if string(data) == "bad" {
+				return 0, fail
+			}
+			return len(data), nil
+		},
+	)
+
+	c := &fakeConn{}
+	if _, err := h.Serve(context.Background(), c, c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process([]byte("ok"), c, c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := process([]byte("bad"), c, c); err != fail {
+		t.Fatalf("expect the error passed through, but got %v", err)
+	}
+
+	out := buf.String()
+	for _, s := range []string{
+		`level=DEBUG msg="[middleware] connection accepted" client.addr=127.0.0.1:2`,
+		`level=DEBUG msg="[middleware] processed" client.addr=127.0.0.1:2 data-len=2 nn=2`,
+		`level=WARN msg="[middleware] processing failed" client.addr=127.0.0.1:2 data-len=3 err="bad frame"`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("expect %q logged, but got:\n%s", s, out)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	var m Metrics
+	fail := errors.New("bad frame")
+	h, process := wrap(m.Middleware(),
+		func(ctx context.Context, w api.Response, r api.Request) (bool, error) { return false, nil },
+		func(data []byte, w api.Response, r api.Request) (int, error) {
+			if string(data) == "bad" {
+				return 0, fail
+			}
+			return len(data), nil
+		},
+	)
+
+	c := &fakeConn{}
+	for i := 0; i < 2; i++ {
+		if _, err := h.Serve(context.Background(), c, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	process([]byte("hello"), c, c)
+	process([]byte("world!"), c, c)
+	process([]byte("bad"), c, c)
+
+	expect := MetricsSnapshot{Connections: 2, Messages: 3, Bytes: 11, Errors: 1}
+	if got := m.Snapshot(); got != expect {
+		t.Fatalf("expect %+v, but got %+v", expect, got)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	var served int
+	h, _ := wrap(Auth(func(ctx context.Context, w api.Response, r api.Request) error {
+		if w.(*fakeConn).out.Len() > 0 {
+			return nil
+		}
+		_, _ = w.Write([]byte("denied\n"))
+		return ErrUnauthorized
+	}),
+		func(ctx context.Context, w api.Response, r api.Request) (bool, error) {
+			served++
+			return false, nil
+		},
+		nil,
+	)
+
+	c := &fakeConn{}
+	processed, err := h.Serve(context.Background(), c, c)
+	if !processed || err != ErrUnauthorized || !c.closed || served != 0 {
+		t.Fatalf("expect the connection rejected, but got %v, %v, closed=%v, served=%d", processed, err, c.closed, served)
+	}
+	if c.out.String() != "denied\n" {
+		t.Fatalf("expect the reply of checker, but got %q", c.out.String())
+	}
+
+	c.closed = false
+	processed, err = h.Serve(context.Background(), c, c)
+	if processed || err != nil || c.closed || served != 1 {
+		t.Fatalf("expect the connection passed, but got %v, %v, closed=%v, served=%d", processed, err, c.closed, served)
+	}
+}
@@ -0,0 +1,56 @@
+package net
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func TestChain(t *testing.T) {
+	var mu sync.Mutex
+	var trace []string
+	add := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		trace = append(trace, s)
+	}
+	mw := func(name string) Middleware {
+		return NewMiddleware(
+			func(next HandlerFunc) HandlerFunc {
+				return func(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+					add("serve:" + name)
+					return next(ctx, w, r)
+				}
+			},
+			func(next OnTcpServerProcessData) OnTcpServerProcessData {
+				return func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+					add("process:" + name)
+					return next(data, w, r)
+				}
+			},
+		)
+	}
+
+	addr, _ := startTestServer(t,
+		WithServerMiddlewares(mw("a"), mw("b")),
+		WithServerOnProcessData(func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+			add("process")
+			return echoProcessor(data, w, r)
+		}),
+	)
+	testEcho(t, addr, 1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	expect := []string{"serve:a", "serve:b", "process:a", "process:b", "process"}
+	if len(trace) != len(expect) {
+		t.Fatalf("expect %v, but got %v", expect, trace)
+	}
+	for i := range expect {
+		if trace[i] != expect[i] {
+			t.Fatalf("expect %v, but got %v", expect, trace)
+		}
+	}
+}
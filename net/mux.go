@@ -0,0 +1,269 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Matcher tells whether a connection speaks a protocol by its leading
+// bytes. It returns more = true if lead is too short to tell, then it
+// is called again after more bytes arrived.
+//
+// lead is owned by Mux, do not retain it.
+type Matcher func(lead []byte) (ok, more bool)
+
+// MatchPrefix matches the connections starting with any of prefixes,
+// such as the leading magics of pi.NewLeadBytes.
+func MatchPrefix(prefixes ...[]byte) Matcher {
+	return func(lead []byte) (ok, more bool) {
+		for _, p := range prefixes {
+			if len(lead) >= len(p) {
+				if bytes.HasPrefix(lead, p) {
+					return true, false
+				}
+			} else if bytes.HasPrefix(p, lead) {
+				more = true
+			}
+		}
+		return
+	}
+}
+
+// MatchAny matches all connections. It is useful as the last route.
+func MatchAny() Matcher {
+	return func(lead []byte) (ok, more bool) { return true, false }
+}
+
+// MatchTLS matches the TLS connections by the record header of the
+// ClientHello: a handshake record of version 3.x.
+func MatchTLS() Matcher {
+	return MatchPrefix([]byte{0x16, 0x03})
+}
+
+// MatchHTTP matches the HTTP/1.x requests by the method, and the
+// HTTP/2 connections by the preface.
+func MatchHTTP() Matcher {
+	return MatchPrefix(httpMethods...)
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("HEAD "), []byte("POST "), []byte("PUT "),
+	[]byte("DELETE "), []byte("CONNECT "), []byte("OPTIONS "),
+	[]byte("TRACE "), []byte("PATCH "), []byte("PRI * HTTP/2.0"),
+}
+
+// MatchProxyProtocol matches the connections beginning with a PROXY
+// protocol header, version 1 or 2.
+func MatchProxyProtocol() Matcher {
+	return MatchPrefix([]byte("PROXY "), []byte("\r\n\r\n\x00\r\nQUIT\n"))
+}
+
+// Mux shares one listener among several protocols. It peeks the first
+// bytes of each accepted connection, and routes it by the matchers in
+// the order of registration, to a Handler or a net.Listener consumer
+// such as http.Server:
+//
+//	mux := net.NewMux()
+//	mux.Handle(net.MatchPrefix(magic), binaryHandler)
+//	go http.Serve(mux.Listener(net.MatchHTTP()), httpHandler)
+//	server := net.NewServer(addr, net.WithServerMux(mux))
+//
+// The connections matching no routes, or sending nothing before the
+// sniff timeout, such as the server-speaks-first protocols, are served
+// by the server as usual.
+//
+// The routes should be registered before the server starts.
+type Mux struct {
+	routes      []muxRoute
+	timeout     time.Duration
+	peekSize    int
+	listenersMu sync.Mutex
+	listeners   []*connListener
+	addr        net.Addr // the server listener address, guarded by listenersMu
+}
+
+type MuxOpt func(m *Mux)
+
+// WithMuxSniffTimeout sets how long to wait for the leading bytes of
+// a connection, 200ms by default.
+func WithMuxSniffTimeout(d time.Duration) MuxOpt {
+	return func(m *Mux) {
+		m.timeout = d
+	}
+}
+
+// WithMuxPeekSize sets how many leading bytes can be peeked at most,
+// 64 by default. The matchers cannot see the bytes beyond it.
+func WithMuxPeekSize(size int) MuxOpt {
+	return func(m *Mux) {
+		m.peekSize = size
+	}
+}
+
+// WithServerMux routes the accepted connections by m, see Mux.
+func WithServerMux(m *Mux) ServerOpt {
+	return func(s *serverWrap) {
+		s.mux = m
+	}
+}
+
+type muxRoute struct {
+	match    Matcher
+	handler  Handler
+	listener *connListener
+}
+
+func NewMux(opts ...MuxOpt) *Mux {
+	m := &Mux{
+		timeout:  200 * time.Millisecond,
+		peekSize: 64,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Handle serves the matched connections by h, with the server options
+// and middlewares, in place of the server Handler.
+func (m *Mux) Handle(match Matcher, h Handler) {
+	m.routes = append(m.routes, muxRoute{match: match, handler: h})
+}
+
+// HandleFunc serves the matched connections by h, see Handle.
+func (m *Mux) HandleFunc(match Matcher, h HandlerFunc) {
+	m.Handle(match, h)
+}
+
+// Listener returns a net.Listener accepting the matched connections.
+// The leading bytes peeked are readable from them still.
+//
+// The listener is closed after the server stopped.
+func (m *Mux) Listener(match Matcher) net.Listener {
+	l := newConnListener(m.getAddr, nil)
+	m.listenersMu.Lock()
+	m.listeners = append(m.listeners, l)
+	m.listenersMu.Unlock()
+	m.routes = append(m.routes, muxRoute{match: match, listener: l})
+	return l
+}
+
+// serve sniffs the connection of c, and routes it.
+func (m *Mux) serve(ctx context.Context, c *connS) {
+	defer c.recoverPanic("mux") // a panic in matchers
+	conn := c.conn.Load()
+	lead, route, err := m.sniff(conn)
+	if err != nil {
+		c.Debug("[mux] sniffing failed", "err", err)
+		c.Close()
+		return
+	}
+	if len(lead) > 0 {
+		conn = &sniffedConn{Conn: conn, lead: lead}
+	}
+
+	switch {
+	case route == nil:
+		c.conn.Store(conn)
+	case route.listener != nil:
+		c.Debug("[mux] routed to listener")
+		c.forgetClient(c)
+		if !route.listener.push(ctx, conn) {
+			_ = conn.Close()
+		}
+		return
+	default:
+		c.conn.Store(conn)
+		c.handler = route.handler
+		if len(c.middlewares) > 0 {
+			c.handler = Chain(c.middlewares...)(c.handler)
+		}
+	}
+	c.run(ctx)
+}
+
+// sniff reads the leading bytes till a route matched, or no routes
+// want more bytes. route is nil if nothing matched.
+func (m *Mux) sniff(conn net.Conn) (lead []byte, route *muxRoute, err error) {
+	if err = conn.SetReadDeadline(time.Now().Add(m.timeout)); err != nil {
+		return
+	}
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	lead = make([]byte, 0, m.peekSize)
+	for {
+		more := false
+		for i := range m.routes {
+			ok, wantMore := m.routes[i].match(lead)
+			if ok {
+				return lead, &m.routes[i], nil
+			}
+			more = more || wantMore
+		}
+		if !more || len(lead) == cap(lead) {
+			return
+		}
+
+		var n int
+		n, err = conn.Read(lead[len(lead):cap(lead)])
+		lead = lead[:len(lead)+n]
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				err = nil // the client waits for the server to speak
+			}
+			return
+		}
+	}
+}
+
+func (m *Mux) setAddr(addr net.Addr) {
+	m.listenersMu.Lock()
+	defer m.listenersMu.Unlock()
+	m.addr = addr
+}
+
+func (m *Mux) getAddr() net.Addr {
+	m.listenersMu.Lock()
+	defer m.listenersMu.Unlock()
+	return m.addr
+}
+
+// close closes the listeners.
+func (m *Mux) close() {
+	m.listenersMu.Lock()
+	defer m.listenersMu.Unlock()
+	for _, l := range m.listeners {
+		l.close()
+	}
+}
+
+// reopen reopens the listeners closed by the server stopping, see
+// Restart.
+func (m *Mux) reopen() {
+	m.listenersMu.Lock()
+	defer m.listenersMu.Unlock()
+	for _, l := range m.listeners {
+		l.reopen()
+	}
+}
+
+// sniffedConn replays the leading bytes peeked before reading from
+// the connection.
+type sniffedConn struct {
+	net.Conn
+	lead []byte
+}
+
+func (c *sniffedConn) Read(p []byte) (n int, err error) {
+	if len(c.lead) > 0 {
+		n = copy(p, c.lead)
+		c.lead = c.lead[n:]
+		return
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,106 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"io"
+	stdnet "net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func TestMatchPrefix(t *testing.T) {
+	match := MatchPrefix([]byte("GET "), []byte("MAGI"))
+	for _, c := range []struct {
+		lead     string
+		ok, more bool
+	}{
+		{"", false, true},
+		{"GE", false, true},
+		{"MAG", false, true},
+		{"GET /", true, false},
+		{"MAGIC", true, false},
+		{"GEX", false, false},
+	} {
+		if ok, more := match([]byte(c.lead)); ok != c.ok || more != c.more {
+			t.Fatalf("%q: expect %v, %v, but got %v, %v", c.lead, c.ok, c.more, ok, more)
+		}
+	}
+}
+
+func TestServer_mux(t *testing.T) {
+	mux := NewMux(WithMuxSniffTimeout(50 * time.Millisecond))
+	mux.Handle(MatchPrefix([]byte("MAGI")), HandlerFunc(func(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+		_, err = w.Write([]byte("binary\n"))
+		return
+	}))
+	hl := mux.Listener(MatchHTTP())
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "http "+r.URL.Path)
+	})}
+	go func() { _ = hs.Serve(hl) }()
+	defer hs.Close()
+
+	addr, _ := startTestServer(t,
+		WithServerMux(mux),
+		WithServerOnProcessData(echoProcessor),
+		WithServerOnClientConnected(func(w api.Response, ss Server) {
+			_, _ = w.Write([]byte("hello\n"))
+		}),
+	)
+
+	t.Run("binary", func(t *testing.T) {
+		conn, scanner := dialLines(t, addr)
+		if _, err := conn.Write([]byte("MAGIC\n")); err != nil {
+			t.Fatal(err)
+		}
+		expectLines(t, scanner, "hello", "binary", "MAGIC")
+	})
+
+	t.Run("http", func(t *testing.T) {
+		resp, err := http.Get("http://" + addr + "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "http /foo" {
+			t.Fatalf("expect %q, but got %q", "http /foo", body)
+		}
+	})
+
+	t.Run("fallback", func(t *testing.T) {
+		conn, scanner := dialLines(t, addr)
+		expectLines(t, scanner, "hello") // the client waits for the greeting
+		if _, err := conn.Write([]byte("plain\n")); err != nil {
+			t.Fatal(err)
+		}
+		expectLines(t, scanner, "plain")
+	})
+}
+
+func dialLines(t *testing.T, addr string) (stdnet.Conn, *bufio.Scanner) {
+	t.Helper()
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewScanner(conn)
+}
+
+func expectLines(t *testing.T, scanner *bufio.Scanner, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !scanner.Scan() {
+			t.Fatal(scanner.Err())
+		}
+		if scanner.Text() != line {
+			t.Fatalf("expect %q, but got %q", line, scanner.Text())
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/hedzr/go-socketlib/net/api"
+	"github.com/hedzr/go-socketlib/net/bufpool"
 )
 
 const defaultBufferSize = 4096
@@ -38,12 +39,17 @@ func NewServer(addr string, opts ...ServerOpt) *serverWrap {
 		network:     "tcp",
 		address:     addr,
 		bufferSize:  defaultBufferSize,
+		wqSize:      defaultWriteQueueSize,
+		wbSize:      defaultWriteBatchSize,
 		connections: make(map[*connS]bool),
 		baseS:       newBaseS(),
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
+	if len(s.middlewares) > 0 {
+		s.handler = Chain(s.middlewares...)(s.handler)
+	}
 	return s
 }
 
@@ -61,6 +67,8 @@ type Server interface {
 	Close()                // = Stop
 
 	WithOnShutdown(cb OnShutdown) Server // set OnShutdown handler
+
+	AsListener() net.Listener // serve the connections by the standard libraries
 }
 
 type ServerOpt func(s *serverWrap)
@@ -74,6 +82,18 @@ type serverWrap struct {
 	tlsConfig  *tls.Config
 	bufferSize int
 	quiet      bool
+	idleBuffer bool             // release the reading buffer while a connection is idle
+	evEnabled  bool             // reactor mode
+	evPollers  int              // the count of reactor pollers
+	pktBatch   int              // the count of packets per recvmmsg in batched datagram mode
+	wqSize     int              // the capacity of writing queue of each connection
+	wqPolicy   WriteQueuePolicy // what to do while the writing queue is full
+	wbSize     int              // max messages coalesced into one writev
+	wbDelay    time.Duration    // how long to wait for more messages before flushing a batch
+
+	wpWorkers   int            // the count of workers, 0 to process data inline
+	wpQueueSize int            // the capacity of worker pool queue
+	wpMode      WorkerPoolMode // how the worker pool orders the data
 
 	onProcessData            OnTcpServerProcessData
 	onCorruptData            OnTcpServerCorruptData
@@ -96,7 +116,27 @@ type serverWrap struct {
 	// lConn       *net.UnixConn
 	handler     Handler
 	connections map[*connS]bool
+	connsMu     sync.Mutex // guards connections
 	exited      int32
+	reactor     reactor     // non-nil in reactor mode
+	pool        *workerPool // non-nil if the worker pool enabled
+	repanic     bool        // re-panic in debug build after a panic recovered
+	connSeq     uint64      // the last connection ID
+	middlewares []Middleware
+	mux         *Mux          // non-nil if sniffing the protocols
+	netListener *connListener // non-nil if AsListener called
+	lnAddr      atomic.Value  // the net.Addr of the listener
+	resumer     *resumer      // non-nil if the session resumption enabled
+
+	authenticator Authenticator // nil if no authentication
+	authTimeout   time.Duration
+
+	unixMode  os.FileMode // the socket file mode, 0 to keep
+	unixUID   int         // the socket file owner, if unixOwner
+	unixGID   int
+	unixOwner bool
+	passFiles int // max files received per message, 0 to disable
+	sockOpts  socketOptions
 
 	baseS
 }
@@ -130,6 +170,9 @@ type CacheWriteable interface {
 	// The default connS.serve will received the data from WrChannel and write
 	// to internal connection rawly.
 	WrChannel() chan<- []byte
+	// Done is closed after the connection closed. Select on it while
+	// sending to WrChannel, so that the sending fails fast.
+	Done() <-chan struct{}
 }
 
 type OnTcpServerCreateReadWriter func(ss Server, conn api.Response, tsConnected time.Time) (in io.Reader, out io.Writer)
@@ -197,6 +240,53 @@ func WithServerMaxMessageLength(l int) ServerOpt {
 	}
 }
 
+// WithServerWriteQueueSize sets the capacity of the cached writing
+// queue of each connection. Default is 16.
+func WithServerWriteQueueSize(size int) ServerOpt {
+	return func(s *serverWrap) {
+		s.wqSize = size
+	}
+}
+
+// WithServerWriteQueuePolicy sets the policy applied by a cached
+// Write while the writing queue of a connection is full.
+//
+// Default is WriteQueueBlock.
+func WithServerWriteQueuePolicy(p WriteQueuePolicy) ServerOpt {
+	return func(s *serverWrap) {
+		s.wqPolicy = p
+	}
+}
+
+// WithServerWriteBatch sets how the writing loop coalesces the
+// queued messages into one vectored write (writev).
+//
+// maxBatch is the max count of messages sent by one syscall,
+// default is 64, and 1 disables the coalescing.
+//
+// flushDelay is an optional small delay to wait for more messages
+// before flushing a batch not full, like the Nagle algorithm at
+// the application level. Default is 0, no waiting.
+func WithServerWriteBatch(maxBatch int, flushDelay time.Duration) ServerOpt {
+	return func(s *serverWrap) {
+		s.wbSize, s.wbDelay = maxBatch, flushDelay
+	}
+}
+
+// WithServerReleaseIdleBuffer gives the reading buffer of a
+// connection back to the shared pool while the connection is idle,
+// so a server with massive idle connections holds no buffers for
+// them.
+//
+// It costs one more syscall for each reading, and it works for plain
+// tcp and unix sockets on unix-like platforms. Other connections
+// keep their reading buffers as usual.
+func WithServerReleaseIdleBuffer(b bool) ServerOpt {
+	return func(s *serverWrap) {
+		s.idleBuffer = b
+	}
+}
+
 func WithServerHandler(h Handler) ServerOpt {
 	return func(s *serverWrap) {
 		s.handler = h
@@ -233,7 +323,9 @@ func WithServerTLSConfig(c *tls.Config) ServerOpt {
 	}
 }
 
-// WithNetwork sets network protocol: tcp, tcp4, tcp6, unix and unixpacket
+// WithNetwork sets network protocol: tcp, tcp4, tcp6, unix, unixpacket,
+// udp, udp4, udp6, unixgram, or a raw IP network such as ip4:icmp and
+// ip6:58.
 func WithNetwork(network string) ServerOpt {
 	return func(s *serverWrap) {
 		s.network = network
@@ -284,16 +376,40 @@ func WithServerOnShutdown(cb OnShutdown) ServerOpt {
 	}
 }
 
-func (s *serverWrap) makeListener() (l net.Listener, err error) {
-	l, err = net.Listen(s.network, s.address)
+func (s *serverWrap) makeListener(ctx context.Context) (l net.Listener, err error) {
+	unixSock := isUnixStream(s.network)
+	if unixSock {
+		if err = s.removeStaleSocket(); err != nil {
+			return
+		}
+	}
+	l, err = s.listenConfig().Listen(ctx, s.network, s.address)
+	if err == nil && unixSock {
+		if err = s.setupUnixSocket(); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+	}
 	if err == nil && s.tlsConfig != nil {
 		l = tls.NewListener(l, s.tlsConfig)
 	}
 	if err == nil {
 		s.closeListener = l.Close
-		if s.network == "unix" || s.network == "unixpacket" {
+		s.lnAddr.Store(l.Addr())
+		if s.mux != nil {
+			s.mux.setAddr(l.Addr())
+		}
+		if unixSock && !isAbstractAddr(s.address) {
 			s.addCloseFunc(func() { _ = os.Remove(s.address) })
 		}
+		if s.evEnabled {
+			var rt reactor
+			if rt, err = newReactor(s, s.evPollers); err != nil {
+				s.Warn("[serverWrap] reactor mode unavailable, fallback to goroutine mode", "err", err)
+				err = nil
+			}
+			s.reactor = rt
+		}
 		s.loop = func(ctx context.Context) (err error) {
 			// timer := time.NewTicker(10 * time.Second)
 			// defer func() {
@@ -305,6 +421,14 @@ func (s *serverWrap) makeListener() (l net.Listener, err error) {
 				s.Info("Server starts listening", "at", l.Addr())
 			}
 
+			if rt := s.reactor; rt != nil {
+				stop := context.AfterFunc(ctx, rt.close)
+				defer func() {
+					stop()
+					rt.close()
+				}()
+			}
+
 			for {
 				var conn net.Conn
 				conn, err = l.Accept()
@@ -316,8 +440,13 @@ func (s *serverWrap) makeListener() (l net.Listener, err error) {
 					}
 				}
 
+				if e := s.sockOpts.applyConn(conn); e != nil {
+					s.Warn("[serverWrap] cannot apply socket options", "remote", conn.RemoteAddr(), "err", e)
+				}
 				s.Debug("[serverWrap] new incoming connection", "remote", conn.RemoteAddr(), "local", conn.LocalAddr())
-				if s.onNewResponse == nil {
+				if s.mux != nil {
+					go s.mux.serve(ctx, newConn(s, conn))
+				} else if s.onNewResponse == nil {
 					go newConn(s, conn).run(ctx)
 				} else {
 					w := s.onNewResponse.New()
@@ -337,43 +466,43 @@ func (s *serverWrap) makeListener() (l net.Listener, err error) {
 	return
 }
 
-func (s *serverWrap) makePacketListener() (conn net.PacketConn, err error) {
-	conn, err = net.ListenPacket(s.network, s.address)
+func (s *serverWrap) makePacketListener(ctx context.Context) (conn net.PacketConn, err error) {
+	conn, err = s.listenConfig().ListenPacket(ctx, s.network, s.address)
+	if err != nil {
+		return
+	}
 	// s.addCloser(conn)
 	s.closeListener = conn.Close
 	s.loop = func(ctx context.Context) (err error) {
-		buf := make([]byte, s.bufferSize*2)
 		s.tryInvokeOnListening(nil)
-		for {
-			var n int
-			var ra net.Addr
-			n, ra, err = conn.ReadFrom(buf)
-			if err != nil {
-				break
-			}
-			str := string(buf[:n])
-			str = strings.TrimSpace(str)
-			s.Debug("received packet", "remote.addr", ra.String(), "data", str)
-			// if i < lim {
-			// 	i++
-			// 	go send(fmt.Sprintf("%d:%d(%s)", pid, i, s))
-			// }
+		if !s.quiet {
+			s.Info("Server starts listening", "at", conn.LocalAddr(), "network", s.network)
 		}
+		if s.pktBatch > 1 && !isIPNetwork(s.network) { // IPConn.ReadFrom strips the IPv4 headers
+			err = s.servePacketsBatched(ctx, conn)
+		} else {
+			err = s.servePackets(ctx, conn)
+		}
+		s.Debug("[serverWrap] server's packet loop ended.", "err", err)
 		return
 	}
 	return
 }
 
-func (s *serverWrap) makeIpListener() (ipConn *net.IPConn, err error) {
-	// if s.ipConn == nil {
-
-	var ipAddr *net.IPAddr
-	ipAddr, err = net.ResolveIPAddr(s.network, s.address) // "unix", "/tmp/echo.sock"
-	if err == nil {
-		ipConn, err = net.ListenIP(s.network, ipAddr)
-		s.closeListener = ipConn.Close
+// makeIpListener listens on a raw IP network, such as "ip4:icmp".
+// The packets are served as the udp ones, and the handlers receive
+// the payload without the IPv4 header and the source *net.IPAddr.
+// It usually needs the privileges, such as CAP_NET_RAW.
+func (s *serverWrap) makeIpListener(ctx context.Context) (ic *net.IPConn, err error) {
+	var conn net.PacketConn
+	if conn, err = s.makePacketListener(ctx); err != nil {
 		return
 	}
+	var ok bool
+	if ic, ok = conn.(*net.IPConn); !ok {
+		_ = conn.Close()
+		return nil, errNotIPConn
+	}
 	return
 }
 
@@ -404,7 +533,23 @@ func (s *serverWrap) Stop() (err error) {
 		// 		c.Close()
 		// 	}
 		// }
+		s.connsMu.Lock()
 		s.connections = nil // NOTE that baseS.closers manage all connections
+		s.connsMu.Unlock()
+
+		if s.pool != nil {
+			s.pool.close()
+			s.pool = nil // rebuilt by Listen, the connections keep theirs
+		}
+		if s.mux != nil {
+			s.mux.close()
+		}
+		if s.netListener != nil {
+			s.netListener.close()
+		}
+		if s.resumer != nil {
+			s.resumer.close()
+		}
 	}
 	return
 }
@@ -425,10 +570,30 @@ func (s *serverWrap) Listen(ctx context.Context) (err error) {
 	// When you write a “unix” or “unixpacket” server, use ListenUnix().
 	//
 
-	switch s.network {
+	// the states below are closed by Stop, renew them for Restart
+	s.connsMu.Lock()
+	if s.connections == nil {
+		s.connections = make(map[*connS]bool)
+	}
+	s.connsMu.Unlock()
+	if s.wpWorkers > 0 && s.pool == nil {
+		s.pool = newWorkerPool(s.wpWorkers, s.wpQueueSize, s.wpMode)
+	}
+	if s.mux != nil {
+		s.mux.reopen()
+	}
+	if s.netListener != nil {
+		s.netListener.reopen()
+	}
+	if s.resumer != nil {
+		s.resumer.reopen()
+	}
+
+	network, _, _ := strings.Cut(s.network, ":") // "ip4:icmp"
+	switch network {
 	case "tcp", "tcp4", "tcp6", "unix", "unixpacket":
 		var l net.Listener
-		if l, err = s.makeListener(); err != nil {
+		if l, err = s.makeListener(ctx); err != nil {
 			s.handleError(err, "[serverWrap] cannot make tcp listener", "addr", s.address)
 			return
 		}
@@ -436,7 +601,7 @@ func (s *serverWrap) Listen(ctx context.Context) (err error) {
 
 	case "udp", "udp4", "udp6", "unixgram":
 		var conn net.PacketConn
-		if conn, err = s.makePacketListener(); err != nil {
+		if conn, err = s.makePacketListener(ctx); err != nil {
 			s.handleError(err, "[serverWrap] cannot make udp listener", "addr", s.address)
 			return
 		}
@@ -454,8 +619,10 @@ func (s *serverWrap) Listen(ctx context.Context) (err error) {
 	// 	return
 
 	case "ip", "ip4", "ip6":
-		err = errUnimplemented // errorsv3.Unimplemented
-		return
+		if _, err = s.makeIpListener(ctx); err != nil {
+			s.handleError(err, "[serverWrap] cannot make ip listener", "addr", s.address)
+			return
+		}
 	}
 
 	return
@@ -608,8 +775,10 @@ func (s *serverWrap) handleListenError(errGot error) (doContinue, doBreak bool,
 
 // Client finds and returns a client's connection object
 func (s *serverWrap) Client(addr string) (conn *connS) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
 	for c := range s.connections {
-		if c.conn.RemoteAddr().String() == addr {
+		if c.RemoteAddrString() == addr {
 			return c
 		}
 	}
@@ -617,12 +786,21 @@ func (s *serverWrap) Client(addr string) (conn *connS) {
 }
 
 func (s *serverWrap) closeClient(conn *connS) {
-	if _, ok := s.connections[conn]; ok {
-		delete(s.connections, conn)
+	if s.forgetClient(conn) {
 		conn.Close()
 	}
 }
 
+// forgetClient removes conn from the connections without closing it.
+func (s *serverWrap) forgetClient(conn *connS) (ok bool) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if _, ok = s.connections[conn]; ok {
+		delete(s.connections, conn)
+	}
+	return
+}
+
 func (s *serverWrap) closeClientByAddr(addr string) {
 	s.closeClient(s.Client(addr))
 }
@@ -634,90 +812,212 @@ func (s *serverWrap) closeClientByAddr(addr string) {
 //
 
 func newConn(s *serverWrap, conn net.Conn) *connS {
+	if s.passFiles > 0 {
+		conn = wrapFiles(conn, s.passFiles)
+	}
 	c := &connS{
 		serverWrap:   s,
-		conn:         conn,
 		tmStart:      time.Now().UTC(),
 		writeTimeout: 5 * time.Second,
-		chWriteSize:  16,
+		wq:           newWriteQueue(s.wqSize, s.wqPolicy),
+		chRaw:        make(chan []byte, s.wqSize),
 		wl:           &sync.Mutex{},
+		id:           atomic.AddUint64(&s.connSeq, 1),
+		handler:      s.handler,
+		sess:         newSession(),
+	}
+	c.conn.Store(conn)
+	c.baseS = baseS{
+		logger:        loggerWith(s.logger, "client.addr", conn.RemoteAddr().String(), "conn.id", c.id),
+		loggerHandler: s.loggerHandler,
 	}
-	c.chWrite = make(chan []byte, c.chWriteSize)
+	if c.pool = s.pool; c.pool != nil && c.pool.mode == WorkerPoolOrdered {
+		c.proc = &procState{ch: make(chan poolItem, c.pool.size)}
+	}
+	s.connsMu.Lock()
 	s.connections[c] = true
+	s.connsMu.Unlock()
 	return c
 }
 
 type connS struct {
 	*serverWrap
-	conn         net.Conn
-	tmStart      time.Time
-	tmStop       time.Time
-	closed       int32
-	writeTimeout time.Duration
-	chWrite      chan []byte
-	chWriteSize  int
-	wl           sync.Locker // specially for RawWrite
-}
-
+	onProcessData OnTcpServerProcessData // resolved for this connection
+	onCorruptData OnTcpServerCorruptData //
+	conn          connRef
+	tmStart       time.Time
+	tmStop        time.Time
+	closed        int32
+	writeTimeout  time.Duration
+	wq            *writeQueue
+	chRaw         chan []byte                     // for WrChannel, bypassing wq
+	wl            sync.Locker                     // specially for RawWrite
+	ctx           atomic.Pointer[context.Context] // the context of run(), for blocking cached writes
+	ev            *evState                        // the state in reactor mode
+	evMode        int32                           // 1 if the connection was handed over to reactor
+	flushing      int32                           // 1 if the short-lived writing goroutine is running, in reactor mode
+	pool          *workerPool                     // the worker pool of the server when accepted, kept across Restart
+	proc          *procState                      // the keyed queue in ordered worker pool mode
+	id            uint64                          // unique in the server
+	handler       Handler                         // the server handler, or the one routed by Mux
+	sess          *Session
+	rs            *resumable // non-nil if the session is resumable
+	principal     *Principal // non-nil if authenticated
+	half          halfState
+	busy          int64 // the chunks being processed by the worker pool
+	finishing     int32 // 1 if closing after EOF
+	hj            hijackState
+	tp            readPause
+	tlsGen        int32 // increased by StartTLS, the bytes read before are plaintext
+	cancel        context.CancelCauseFunc
+
+	baseS // the connection logger, with client.addr and conn.id
+}
+
+// WrChannel returns a channel to send messages to the writing loop
+// directly, buffered by the size of the writing queue. The writing
+// queue policy and the completion notification are not available for
+// these messages, and it is not served in reactor mode.
+//
+// Nothing receives from it after the connection closed, so select on
+// Done while sending:
+//
+//	select {
+//	case w.WrChannel() <- data:
+//	case <-w.Done():
+//		// closed
+//	}
 func (s *connS) WrChannel() chan<- []byte {
-	return s.chWrite
+	return s.chRaw
 }
 
+// Done returns a channel closed after the connection closed.
+func (s *connS) Done() <-chan struct{} { return s.wq.done }
+
+func (s *connS) WriteQueueLen() int       { return s.wq.Len() }
+func (s *connS) WriteQueueCap() int       { return s.wq.Cap() }
+func (s *connS) WriteQueueDropped() int64 { return s.wq.Dropped() }
+
 func (s *connS) RemoteAddr() net.Addr {
-	if s.conn == nil {
+	conn := s.conn.Load()
+	if conn == nil {
 		return nil
 	}
-	return s.conn.RemoteAddr()
+	return conn.RemoteAddr()
 }
 
 func (s *connS) RemoteAddrString() string {
-	if s.conn == nil {
+	conn := s.conn.Load()
+	if conn == nil {
 		return "(not-connected)"
 	}
-	return s.conn.RemoteAddr().String()
+	return conn.RemoteAddr().String()
 }
 
 func (s *connS) LocalAddr() net.Addr {
-	if s.conn == nil {
+	conn := s.conn.Load()
+	if conn == nil {
 		return nil
 	}
-	return s.conn.LocalAddr()
+	return conn.LocalAddr()
 }
 
 func (s *connS) Closed() bool    { return atomic.LoadInt32(&s.closed) != 0 }
 func (s *connS) NotClosed() bool { return atomic.LoadInt32(&s.closed) == 0 }
-func (s *connS) Connected() bool { return s.conn != nil }
+func (s *connS) Connected() bool { return s.conn.Load() != nil }
 func (s *connS) Close()          { _ = s.SafeClose() }
 func (s *connS) SafeClose() (err error) {
 	if atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
-		if s.conn != nil {
-			if err = s.conn.Close(); err != nil {
-				s.handleError(err, "close connection failed", "client.addr", s.conn.RemoteAddr())
+		s.wq.close()
+		if s.inReactor() {
+			defer s.closeInReactor()
+			if ev := s.ev; ev != nil {
+				ev.poller.remove(ev.fd) // before closing the fd
+			}
+		}
+		if conn := s.conn.Swap(nil); conn != nil {
+			if err = conn.Close(); err != nil {
+				s.handleError(err, "close connection failed", "client.addr", conn.RemoteAddr())
 			}
-			s.conn = nil
 		}
+		if s.cancel != nil {
+			s.cancel(net.ErrClosed)
+		}
+		s.closeSession()
 	}
 	return
 }
 
 func (s *connS) GetClientID() string {
-	if s.conn == nil {
+	conn := s.conn.Load()
+	if conn == nil {
 		return ""
 	}
-	return s.conn.RemoteAddr().String()
+	return conn.RemoteAddr().String()
 }
 
 func (s *connS) Write(data []byte) (n int, err error) {
+	return s.WriteContext(s.connCtx(), data)
+}
+
+// WriteContext puts data into the writing queue. If the queue is
+// full, the server's WriteQueuePolicy is applied, and ctx is used
+// by WriteQueueBlock policy.
+func (s *connS) WriteContext(ctx context.Context, data []byte) (n int, err error) {
 	if n = len(data); n > 0 {
-		s.chWrite <- data
-		s.Verbose("[connS] Write() cached one message.")
+		if err = s.enqueue(ctx, newPooledWriteReq(data, false, nil)); err != nil {
+			n = 0
+		}
 	}
 	return
 }
 
+func (s *connS) WriteAsync(ctx context.Context, data []byte) api.WriteCompletion {
+	if len(data) == 0 {
+		return resolvedWrite(0, nil)
+	}
+	req := newPooledWriteReq(data, true, nil)
+	_ = s.enqueue(ctx, req)
+	return req
+}
+
+func (s *connS) WriteWithCallback(ctx context.Context, data []byte, cb func(n int, err error)) {
+	if len(data) == 0 {
+		if cb != nil {
+			cb(0, nil)
+		}
+		return
+	}
+	_ = s.enqueue(ctx, newPooledWriteReq(data, false, cb))
+}
+
+func (s *connS) enqueue(ctx context.Context, req *writeReq) (err error) {
+	if req.data != nil && s.half.has(halfWrite) { // the barriers pass
+		req.resolve(0, api.ErrWriteClosed)
+		return api.ErrWriteClosed
+	}
+	var disconnect bool
+	if disconnect, err = s.wq.push(ctx, req); err != nil {
+		if disconnect {
+			s.Warn("[connS] writing queue full, disconnecting slow consumer", "client.addr", s.RemoteAddrString(), "queue.len", s.wq.Len())
+			s.Close()
+		}
+		return
+	}
+	s.kickWriter()
+	s.Verbose("[connS] Write() cached one message.")
+	return
+}
+
+// RawWrite writes data to the connection immediately. The deadline
+// of ctx is applied if it is earlier than the default write timeout,
+// and the writing is interrupted if ctx is cancelled.
 func (s *connS) RawWrite(ctx context.Context, data []byte) (n int, err error) {
+	if s.half.has(halfWrite) {
+		return 0, api.ErrWriteClosed
+	}
 	if n = len(data); n > 0 {
-		n, err = s.rawWriteNow(data, s.writeTimeout)
+		n, err = writeContext(ctx, &s.conn, s.wl, data, s.writeTimeout)
 	}
 	return
 }
@@ -734,48 +1034,114 @@ func (s *connS) RawWriteTimeout(data []byte, deadline ...time.Duration) (n int,
 }
 
 func (s *connS) rawWriteNow(data []byte, deadline time.Duration) (n int, err error) {
-	err = s.conn.SetWriteDeadline(time.Now().Add(deadline))
+	s.wl.Lock() // lock before taking s.conn, which StartTLS replaces under the lock
+	defer s.wl.Unlock()
+	conn := s.conn.Load()
+	if conn == nil {
+		return 0, net.ErrClosed
+	}
+	if s.half.has(halfWrite) {
+		return 0, api.ErrWriteClosed
+	}
+	if err = conn.SetWriteDeadline(time.Now().Add(deadline)); err == nil {
+		n, err = conn.Write(data)
+	}
+	return
+}
 
-	if err == nil {
-		s.wl.Lock()
-		defer s.wl.Unlock()
-		n, err = s.conn.Write(data)
+// rawWriteBuffers sends bufs with one vectored write if the
+// underlying connection supports it.
+func (s *connS) rawWriteBuffers(bufs net.Buffers) (n int64, err error) {
+	s.wl.Lock()
+	defer s.wl.Unlock()
+	conn := s.conn.Load()
+	if conn == nil {
+		return 0, net.ErrClosed
+	}
+	if s.half.has(halfSealed) { // queued behind the barrier of CloseWrite
+		return 0, api.ErrWriteClosed
+	}
+	if err = conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err == nil {
+		if rc, ok := conn.(*resumeConn); ok {
+			n, err = rc.writeBuffers(bufs)
+		} else {
+			n, err = bufs.WriteTo(conn)
+		}
 	}
 	return
 }
 
 func (s *connS) Read(p []byte) (n int, err error) {
-	if s.NotClosed() {
-		n, err = s.conn.Read(p)
+	if conn := s.conn.Load(); conn != nil && s.NotClosed() {
+		n, err = conn.Read(p)
 		// err = errorsv3.MethodNotAllowed // read directly is not allowed
+	} else {
+		err = net.ErrClosed
 	}
 	return
 }
 
-func (s *connS) defaultProcessData(data []byte, w api.Response, r api.Request) (nn int, err error) {
+func (s *serverWrap) defaultProcessData(data []byte, w api.Response, r api.Request) (nn int, err error) {
 	s.Debug("[connS] RECV:", "data", string(data), "client.addr", w.RemoteAddr())
 	nn = len(data)
 	return
 }
 
-func (s *connS) run(ctx context.Context) {
-	s.tryInvokeOnClientConnected(s)
-	// reader, writer := s.TryInvokeOnCreateReadWriter(s.conn, s.tmStart)
-	defer s.tryInvokeOnClientDisconnected(s, s)
+// processors returns the data processing callbacks provided by h,
+// or the server-wide ones, or the defaults.
+func (s *serverWrap) processors(h Handler) (process OnTcpServerProcessData, corrupt OnTcpServerCorruptData) {
+	process, corrupt = s.onProcessData, s.onCorruptData
+	if process == nil {
+		process = s.defaultProcessData
+	}
 
-	if z, hasProcess := s.handler.(DataProcessor); hasProcess {
-		s.onProcessData = z.Process
+	if z, isWrapper := h.(ProcessWrapper); isWrapper {
+		process = z.WrapProcess(process)
+	} else if z, hasProcess := h.(DataProcessor); hasProcess {
+		process = z.Process
 	}
-	if s.onProcessData == nil {
-		s.onProcessData = s.defaultProcessData
+
+	if z, hasCD := corruptDataFinder(h); hasCD {
+		corrupt = z.OnCorruptData
+	}
+	if corrupt == nil {
+		corrupt = func(data []byte, w api.Response, r api.Request) (ate int) { return len(data) }
 	}
+	return
+}
 
-	if z, hasCD := s.handler.(CorruptDataFinder); hasCD {
-		s.onCorruptData = z.OnCorruptData
+// connCtx returns the per-connection context, or the background
+// context before run.
+func (s *connS) connCtx() context.Context {
+	if p := s.ctx.Load(); p != nil {
+		return *p
 	}
-	if s.onCorruptData == nil {
-		s.onCorruptData = func(data []byte, w api.Response, r api.Request) (ate int) { return len(data) }
+	return context.Background()
+}
+
+func (s *connS) run(ctx context.Context) {
+	defer s.recoverPanic("serve")
+	ctx, s.cancel = context.WithCancelCause(ctx)
+	ctx = withConnInfo(ctx, &connInfo{conn: s, logger: s.logger, id: s.id, accepted: s.tmStart})
+	s.ctx.Store(&ctx)
+	if s.authenticator != nil && !s.authenticate(ctx) {
+		s.Close()
+		return
 	}
+	if s.resumer != nil && !s.resumeHandshake(ctx) {
+		s.Close()
+		return
+	}
+	s.tryInvokeOnClientConnected(s)
+	// reader, writer := s.TryInvokeOnCreateReadWriter(s.conn, s.tmStart)
+	detached := false
+	defer func() {
+		if !detached && !s.hj.isHijacked() { // the reactor invokes it on closing
+			s.tryInvokeOnClientDisconnected(s, s)
+		}
+	}()
+
+	s.onProcessData, s.onCorruptData = s.processors(s.handler)
 
 	if s.handler != nil {
 		if processed, err := s.handler.Serve(ctx, s, s); err != nil {
@@ -786,14 +1152,43 @@ func (s *connS) run(ctx context.Context) {
 		}
 	}
 
+	if s.hj.isHijacked() {
+		return // taken over in Handler.Serve
+	}
+	if s.netListener != nil {
+		s.serveNetConn(ctx) // the listener adapter takes over it
+		return
+	}
+	if detached = s.detach(); detached {
+		return // the reactor takes over it
+	}
+
 	// fallback to default serve routine
 	s.serve(ctx, s, s)
 }
 
 func (s *connS) serve(ctx context.Context, w api.Response, r api.Request) {
-	defer s.Close()
+	if !s.hj.startLoops() {
+		return
+	}
 	s.Verbose("[connS] looper - entering...")
 	go s.readBump(ctx, w, r)
+	s.writeLoop(ctx)
+}
+
+// writeLoop writes the cached messages till the connection closed.
+func (s *connS) writeLoop(ctx context.Context) {
+	defer func() {
+		defer close(s.hj.writeDone)
+		if !s.hj.isHijacked() {
+			s.Close()
+			if s.rs != nil {
+				s.resumer.handOff(s) // the session keeps them for resuming
+			} else {
+				s.wq.discard(net.ErrClosed)
+			}
+		}
+	}()
 writeBump:
 	for {
 		select {
@@ -801,20 +1196,26 @@ writeBump:
 			s.Debug("[connS] looper/writeBump ended.")
 			break writeBump
 
-		case data := <-s.chWrite:
-			s.Verbose("[connS] rawWriteNow wake up")
-			if len(data) == 0 {
-				continue
-			}
-			if pi := s.protocolInterceptor; pi != nil {
-				if processed, err := pi.OnWriting(ctx, s, data); processed {
-					continue
-				} else if err != nil {
-					s.Error("[connS] Write failed", "err", err)
-					break writeBump
-				}
+		case <-s.wq.done:
+			s.Debug("[connS] looper/writeBump ended, connection closed.")
+			break writeBump
+
+		case <-s.hj.stop:
+			s.Debug("[connS] looper/writeBump ended, hijacked.")
+			s.flushPending(ctx)
+			break writeBump
+
+		case data := <-s.chRaw:
+			s.Verbose("[connS] rawWriteNow wake up (raw channel)")
+			if err := writeBatch(ctx, s.protocolInterceptor, s, []*writeReq{newWriteReq(data, false, nil)}, s.rawWriteBuffers); err != nil {
+				s.handleError(err, "[connS] Write failed")
+				break writeBump
 			}
-			if _, err := s.rawWriteNow(data, s.writeTimeout); err != nil {
+
+		case req := <-s.wq.ch:
+			s.Verbose("[connS] rawWriteNow wake up")
+			batch := s.wq.drain(req, s.wbSize, s.wbDelay)
+			if err := writeBatch(ctx, s.protocolInterceptor, s, batch, s.rawWriteBuffers); err != nil {
 				s.handleError(err, "[connS] Write failed")
 				break writeBump
 			}
@@ -825,18 +1226,56 @@ writeBump:
 }
 
 func (s *connS) readBump(ctx context.Context, w api.Response, r api.Request) {
-	var nRead, pos int
-	buf := make([]byte, s.bufferSize*2)
-	cidHolder, ok := r.(interface{ GetClientID() string })
-	if !ok || cidHolder == nil {
-		cidHolder = s
-	}
+	defer s.recoverPanic("readBump")
+	defer close(s.hj.readDone)
+	var eof bool
+	defer func() {
+		if s.hj.isHijacked() {
+			return
+		}
+		if eof {
+			s.readEnded() // the writing goes on till the data received was replied
+		} else {
+			s.Close() // the reading failed, close the connection and stop the writing loop
+		}
+	}()
+	var pos int
+	buf := bufpool.Get(s.bufferSize * 2)
+	defer func() { bufpool.Put(buf) }()
+	releaseIdle := s.idleBuffer && r == api.Request(s)
 
 workingLoop:
 	for {
+		if releaseIdle && pos == 0 && canWaitReadable(s.conn.Load()) { // not after StartTLS
+			// nothing pending, give the buffer back while waiting
+			bufpool.Put(buf)
+			buf = nil
+			if err := waitReadable(s.conn.Load()); err != nil {
+				if s.tp.park() {
+					buf = bufpool.Get(s.bufferSize * 2)
+					continue
+				}
+				if s.hj.isHijacked() {
+					break workingLoop
+				}
+				eof = errors.Is(err, io.EOF)
+				s.handleReadError(0, err, buf, pos, w, r)
+				break workingLoop
+			}
+			buf = bufpool.Get(s.bufferSize * 2)
+		}
+
 		s.Verbose("[connS] read once", "pos", pos)
 		n, err := r.Read(buf[pos : pos+s.bufferSize])
 		if err != nil {
+			if n == 0 && s.tp.park() {
+				continue // resumed after StartTLS
+			}
+			if s.hj.isHijacked() {
+				s.hj.handBack(buf[:pos+n])
+				break workingLoop
+			}
+			eof = errors.Is(err, io.EOF)
 			s.handleReadError(n, err, buf, pos, w, r)
 			break workingLoop
 		} else if n == 0 {
@@ -851,34 +1290,68 @@ workingLoop:
 		default:
 		}
 
-		nEnd := pos + n
-		nRead, err = s.onProcessData(buf[:nEnd], w, r)
-		// s.Verbose("[connS] onProcessData processed", "nRead", nRead, "nEnd", nEnd, "err", err)
-
-		if nRead <= 0 {
-			// bad package found, skip the pieces and try to recover
-			s.Warn("[connS] data block decode failed, skipped.", "client.addr", w.RemoteAddr(), "client.id", cidHolder.GetClientID(), "data", buf[:nEnd], "err", err)
-			pos = s.onCorruptData(buf[:nEnd], w, r)
-			if pos == nEnd {
-				pos = 0
-			} else {
-				copy(buf, buf[pos:nEnd])
-				pos = nEnd - pos
-			}
-			continue
+		var ok bool
+		atomic.StoreInt32(&s.hj.inProcess, 1)
+		pos, ok = s.dispatch(buf, pos, n, w, r)
+		atomic.StoreInt32(&s.hj.inProcess, 0)
+		if !ok || s.hj.isHijacked() {
+			break workingLoop // if hijacked, the data processor has got all bytes read
 		}
+	}
+}
 
-		if err != nil {
-			s.handleError(err, "[connS] onProcessData(buf, wr) failed.", "client.addr", w.RemoteAddr(), "client.id", cidHolder.GetClientID(), "nRead", nRead)
-			break workingLoop
+// consume hands the pending bytes, buf[:pos+n], to onProcessData,
+// and moves the unprocessed bytes to the beginning of buf.
+//
+// It returns the position for the next reading, or ok = false if
+// the connection should be closed.
+func (s *connS) consume(buf []byte, pos, n int, w api.Response, r api.Request) (next int, ok bool) {
+	cidHolder, isHolder := r.(interface{ GetClientID() string })
+	if !isHolder || cidHolder == nil {
+		cidHolder = s
+	}
+
+	nEnd := pos + n
+	gen := atomic.LoadInt32(&s.tlsGen)
+	nRead, err := s.onProcessData(buf[:nEnd], w, r)
+	if gen != atomic.LoadInt32(&s.tlsGen) && err == nil && nRead < nEnd {
+		// StartTLS was called, the rest was received in plaintext
+		s.Warn("[connS] plaintext after StartTLS discarded", "bytes", nEnd-max(nRead, 0))
+		return 0, true
+	}
+	// s.Verbose("[connS] onProcessData processed", "nRead", nRead, "nEnd", nEnd, "err", err)
+
+	if nRead <= 0 && errors.Is(err, ErrIncompleteFrame) {
+		if nEnd > s.bufferSize {
+			s.handleError(errFrameTooLarge, "[connS] incomplete frame overflowed the reading buffer", "client.addr", w.RemoteAddr(), "bytes", nEnd)
+			return 0, false
+		}
+		return nEnd, true // keep the bytes, and read more
+	}
+	if nRead <= 0 {
+		// bad package found, skip the pieces and try to recover
+		s.Warn("[connS] data block decode failed, skipped.", "client.addr", w.RemoteAddr(), "client.id", cidHolder.GetClientID(), "data", buf[:nEnd], "err", err)
+		next = s.onCorruptData(buf[:nEnd], w, r)
+		if next == nEnd {
+			next = 0
+		} else {
+			copy(buf, buf[next:nEnd])
+			next = nEnd - next
 		}
+		return next, true
+	}
 
-		pos = nRead
-		if pos < nEnd {
-			copy(buf, buf[pos:nEnd]) // move the rest bytes to the beginning of buffer
-		} // else pos == nEnd
-		pos = nEnd - pos // and set the ending position
+	if err != nil {
+		s.handleError(err, "[connS] onProcessData(buf, wr) failed.", "client.addr", w.RemoteAddr(), "client.id", cidHolder.GetClientID(), "nRead", nRead)
+		return 0, false
 	}
+
+	next = nRead
+	if next < nEnd {
+		copy(buf, buf[next:nEnd]) // move the rest bytes to the beginning of buffer
+	} // else next == nEnd
+	next = nEnd - next // and set the ending position
+	return next, true
 }
 
 func (s *connS) handleReadError(n int, err error, buf []byte, pos int, w api.Response, r api.Request) {
@@ -888,7 +1361,7 @@ func (s *connS) handleReadError(n int, err error, buf []byte, pos int, w api.Res
 	}
 
 	if errors.Is(err, io.EOF) {
-		s.Debug("[connS] ♦︎ read i/o eof found. closing connection...", "client.addr", w.RemoteAddr(), "client.id", cidHolder.GetClientID())
+		s.Debug("[connS] ♦︎ read i/o eof found, the reading side ended.", "client.addr", w.RemoteAddr(), "client.id", cidHolder.GetClientID())
 		return
 	}
 	if n > 0 {
@@ -904,7 +1377,7 @@ func (s *connS) handleReadError(n int, err error, buf []byte, pos int, w api.Res
 func (s *connS) handleError(err error, reason string, args ...any) {
 	s.baseS.handleError(err, reason, args...)
 	if s.NotClosed() {
-		err = checkConn(s.conn) // try inspecting raw error
+		err = checkConn(s.conn.Load()) // try inspecting raw error
 		if err != nil {
 			s.Error("ERROR", "err-after-check-conn", err)
 		}
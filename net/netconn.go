@@ -0,0 +1,234 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+var (
+	errNotServerConn = errors.New("not a server connection")
+	errLoopsRunning  = errors.New("the connection loops are running")
+)
+
+// AsListener returns a net.Listener yielding the accepted connections
+// as net.Conn, so that the standard libraries, such as net/http, can
+// serve them:
+//
+//	go http.Serve(server.AsListener(), mux)
+//	err := server.ListenAndServe(ctx, nil)
+//
+// The connections pass through the same accept pipeline as usual:
+// OnClientConnected, the middlewares and Handler.Serve. Those not
+// processed by Handler.Serve are handed over to the listener, instead
+// of the default reading loop. See AsNetConn for the adapter.
+//
+// It must be called before the server starts. Closing the listener
+// stops the server.
+func (s *serverWrap) AsListener() net.Listener {
+	if s.netListener == nil {
+		s.netListener = newConnListener(s.listenAddr, func() { _ = s.Stop() })
+	}
+	return s.netListener
+}
+
+func (s *serverWrap) listenAddr() net.Addr {
+	addr, _ := s.lnAddr.Load().(net.Addr)
+	return addr
+}
+
+// serveNetConn hands the connection over to the listener adapter, and
+// runs the writing loop till the connection closed.
+func (s *connS) serveNetConn(ctx context.Context) {
+	if !s.hj.startLoops() {
+		return
+	}
+	close(s.hj.readDone) // the reading is done by the consumer
+	if !s.netListener.push(ctx, &netConn{c: s}) {
+		s.Close()
+	}
+	s.writeLoop(ctx)
+}
+
+// AsNetConn returns a net.Conn adapter of a server connection, which
+// maps Read, Write and the deadlines onto it:
+//
+//   - Read reads the connection directly, bypassing OnProcessData.
+//   - Write puts the data into the writing queue and waits for the
+//     writing done, so the interceptors, write batching and queue
+//     policy apply.
+//   - Close closes the connection.
+//
+// It can be called in Handler.Serve, before the reading loop started,
+// then Handler.Serve should serve the adapter till the end and return
+// processed = true.
+func AsNetConn(w api.Response) (conn net.Conn, err error) {
+	s, ok := w.(*connS)
+	if !ok {
+		return nil, errNotServerConn
+	}
+	if s.Closed() {
+		return nil, net.ErrClosed
+	}
+	if s.inReactor() || !s.hj.startLoops() {
+		return nil, errLoopsRunning
+	}
+	close(s.hj.readDone)
+	go s.writeLoop(s.connCtx())
+	return &netConn{c: s}, nil
+}
+
+// netConn is the net.Conn adapter of connS.
+type netConn struct {
+	c  *connS
+	mu sync.Mutex
+	wd time.Time // the write deadline
+}
+
+func (n *netConn) Read(p []byte) (int, error) {
+	conn := n.c.conn.Load()
+	if conn == nil || n.c.Closed() {
+		return 0, net.ErrClosed
+	}
+	return conn.Read(p)
+}
+
+func (n *netConn) Write(p []byte) (written int, err error) {
+	ctx := n.c.connCtx()
+	n.mu.Lock()
+	wd := n.wd
+	n.mu.Unlock()
+	if !wd.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, wd)
+		defer cancel()
+	}
+
+	written, err = n.c.WriteAsync(ctx, p).Wait(ctx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		err = os.ErrDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		err = net.ErrClosed
+	}
+	return
+}
+
+func (n *netConn) Close() error {
+	if n.c.Closed() {
+		return net.ErrClosed
+	}
+	return n.c.SafeClose()
+}
+
+func (n *netConn) LocalAddr() net.Addr  { return n.c.LocalAddr() }
+func (n *netConn) RemoteAddr() net.Addr { return n.c.RemoteAddr() }
+
+func (n *netConn) SetDeadline(t time.Time) error {
+	if err := n.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return n.SetWriteDeadline(t)
+}
+
+func (n *netConn) SetReadDeadline(t time.Time) error {
+	conn := n.c.conn.Load()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	return conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline applies to the waiting for the writing queue and
+// the completion. A message timed out may be sent later still.
+func (n *netConn) SetWriteDeadline(t time.Time) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.wd = t
+	return nil
+}
+
+// connListener is a net.Listener of the connections handed over by
+// the server or Mux.
+type connListener struct {
+	ch      chan net.Conn
+	mu      sync.Mutex
+	done    chan struct{} // replaced by reopen, guarded by mu
+	closed  bool
+	addr    func() net.Addr
+	onClose func() // called by Close, nil for nothing
+}
+
+func newConnListener(addr func() net.Addr, onClose func()) *connListener {
+	return &connListener{
+		ch:      make(chan net.Conn),
+		done:    make(chan struct{}),
+		addr:    addr,
+		onClose: onClose,
+	}
+}
+
+// push hands conn over to Accept. It returns false if the listener
+// or the server has been closed.
+func (l *connListener) push(ctx context.Context, conn net.Conn) bool {
+	select {
+	case l.ch <- conn:
+		return true
+	case <-l.doneCh():
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ch:
+		return conn, nil
+	case <-l.doneCh():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.close()
+	if l.onClose != nil {
+		l.onClose()
+	}
+	return nil
+}
+
+// close closes the listener without calling onClose.
+func (l *connListener) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.done)
+	}
+}
+
+// reopen lets the closed listener accept again, after the server
+// restarted.
+func (l *connListener) reopen() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		l.closed = false
+		l.done = make(chan struct{})
+	}
+}
+
+func (l *connListener) doneCh() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.done
+}
+
+// Addr returns the address of the server listener, or nil before the
+// server started.
+func (l *connListener) Addr() net.Addr { return l.addr() }
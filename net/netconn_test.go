@@ -0,0 +1,80 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func TestServer_asListener(t *testing.T) {
+	var served int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewServer("127.0.0.1:0",
+		WithServerQuiet(true),
+		WithServerLogger(testLogger()),
+		WithServerMiddlewares(NewMiddleware(func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+				atomic.AddInt32(&served, 1)
+				return next(ctx, w, r)
+			}
+		}, nil)),
+	)
+	l := s.AsListener()
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	})}
+	go func() { _ = hs.Serve(l) }()
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer hs.Close()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "hello /foo" {
+		t.Fatalf("expect %q, but got %q", "hello /foo", body)
+	}
+	if atomic.LoadInt32(&served) != 1 {
+		t.Fatalf("expect the connection passed through the middleware")
+	}
+
+	_ = l.Close() // stops the server
+	if _, err = l.Accept(); err == nil {
+		t.Fatal("expect Accept failed after closed")
+	}
+}
+
+func TestAsNetConn(t *testing.T) {
+	addr, _ := startTestServer(t, WithServerHandlerFunc(func(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+		conn, err := AsNetConn(w)
+		if err != nil {
+			return true, err
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			if _, err = conn.Write([]byte("net:" + scanner.Text() + "\n")); err != nil {
+				break
+			}
+		}
+		return true, err
+	}))
+
+	conn, scanner := dialLines(t, addr)
+	for _, line := range []string{"hello", "world"} {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		expectLines(t, scanner, "net:"+line)
+	}
+}
@@ -0,0 +1,212 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/hedzr/is"
+
+	"github.com/hedzr/go-socketlib/net/api"
+	"github.com/hedzr/go-socketlib/net/bufpool"
+)
+
+// WithServerPacketBatch enables the batched datagram mode for udp
+// and unixgram servers. The packet loop reads up to size packets by
+// one recvmmsg syscall, and the replies written while processing
+// them are sent by one sendmmsg syscall.
+//
+// The handlers are the same as the normal mode. It is available on
+// Linux, and other platforms fall back to the normal mode.
+func WithServerPacketBatch(size int) ServerOpt {
+	return func(s *serverWrap) {
+		s.pktBatch = size
+	}
+}
+
+// servePackets reads and processes one packet at a time.
+func (s *serverWrap) servePackets(ctx context.Context, pc net.PacketConn) (err error) {
+	process, _ := s.processors(s.handler)
+	buf := bufpool.Get(s.bufferSize * 2)
+	defer bufpool.Put(buf)
+	for {
+		var n int
+		var ra net.Addr
+		n, ra, err = pc.ReadFrom(buf)
+		if err != nil {
+			if s.IsExited() {
+				err = nil
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		s.handlePacket(ctx, pc, ra, buf[:n], nil, process)
+	}
+}
+
+// handlePacket runs the interceptor and the data processor for one
+// incoming packet.
+func (s *serverWrap) handlePacket(ctx context.Context, pc net.PacketConn, ra net.Addr, data []byte, out *packetOut, process OnTcpServerProcessData) {
+	s.Verbose("received packet", "remote.addr", ra, "data-len", len(data))
+	p := &packetS{serverWrap: s, ctx: ctx, pc: pc, remote: ra, data: data, out: out}
+	defer func() {
+		if v := recover(); v != nil {
+			s.reportPanic(ctx, &PanicError{Value: v, Stack: debug.Stack(), Where: "packet"}, p, "remote.addr", ra)
+			if s.repanic && is.DebugBuild() {
+				panic(v)
+			}
+		}
+	}()
+
+	if ui, ok := s.protocolInterceptor.(api.UdpInterceptor); ok {
+		if ua, ok := ra.(*net.UDPAddr); ok {
+			if processed, err := ui.OnUdpReading(ctx, api.NewUdpPacket(ua, data)); processed {
+				return
+			} else if err != nil {
+				s.handleError(err, "[serverWrap] OnUdpReading failed", "remote.addr", ra)
+				return
+			}
+		}
+	}
+
+	if _, err := process(data, p, p); err != nil {
+		s.handleError(err, "[serverWrap] process packet failed", "remote.addr", ra)
+	}
+}
+
+// packetS is the api.Response and api.Request of an incoming packet.
+//
+// The packet data is valid only while processing it.
+type packetS struct {
+	*serverWrap
+	ctx    context.Context
+	pc     net.PacketConn
+	remote net.Addr
+	data   []byte
+	pos    int
+	out    *packetOut // collects the replies in batched mode
+}
+
+func (p *packetS) LocalAddr() net.Addr  { return p.pc.LocalAddr() }
+func (p *packetS) RemoteAddr() net.Addr { return p.remote }
+func (p *packetS) GetClientID() string  { return p.RemoteAddrString() }
+
+func (p *packetS) RemoteAddrString() string {
+	if p.remote == nil {
+		return "(unnamed)"
+	}
+	return p.remote.String()
+}
+
+// Close does nothing since a datagram has no connection.
+func (p *packetS) Close() {}
+
+// Read reads the packet data.
+func (p *packetS) Read(b []byte) (n int, err error) {
+	n = copy(b, p.data[p.pos:])
+	p.pos += n
+	return
+}
+
+// Write sends a reply packet to the remote address.
+//
+// In batched mode, the replies written while processing are sent
+// together after the batch processed.
+func (p *packetS) Write(data []byte) (n int, err error) {
+	if n = len(data); n == 0 {
+		return
+	}
+	if ui, ok := p.protocolInterceptor.(api.UdpInterceptor); ok {
+		if ua, ok := p.remote.(*net.UDPAddr); ok {
+			var processed bool
+			if processed, err = ui.OnUdpWriting(p.ctx, api.NewUdpPacket(ua, data)); processed || err != nil {
+				return
+			}
+		}
+	}
+	if p.remote == nil {
+		return 0, errUnnamedPeer
+	}
+	if p.out != nil && p.out.add(p.remote, data) {
+		return
+	}
+	return p.pc.WriteTo(data, p.remote)
+}
+
+func (p *packetS) RawWrite(ctx context.Context, data []byte) (n int, err error) {
+	return p.pc.WriteTo(data, p.remote)
+}
+
+func (p *packetS) RawWriteTimeout(data []byte, deadline ...time.Duration) (n int, err error) {
+	return p.pc.WriteTo(data, p.remote)
+}
+
+// PeerCred returns api.ErrPeerCredUnsupported, since a datagram peer
+// is not connected.
+func (p *packetS) PeerCred() (cred api.PeerCred, err error) {
+	return cred, api.ErrPeerCredUnsupported
+}
+
+// CloseWrite returns api.ErrHalfCloseUnsupported.
+func (p *packetS) CloseWrite() error { return api.ErrHalfCloseUnsupported }
+
+// CloseRead returns api.ErrHalfCloseUnsupported.
+func (p *packetS) CloseRead() error { return api.ErrHalfCloseUnsupported }
+
+var errUnnamedPeer = errors.New("cannot reply to an unnamed peer")
+
+// packetOut collects the reply packets of a batch.
+type packetOut struct {
+	mu   sync.Mutex
+	open bool
+	msgs []outPacket
+}
+
+type outPacket struct {
+	addr net.Addr
+	data []byte // pooled
+}
+
+// add puts a copy of data into the batch. It returns false if the
+// batch has been flushed already.
+func (o *packetOut) add(addr net.Addr, data []byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.open {
+		return false
+	}
+	o.msgs = append(o.msgs, outPacket{addr, bufpool.Clone(data)})
+	return true
+}
+
+// reset opens the batch for collecting.
+func (o *packetOut) reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.open, o.msgs = true, o.msgs[:0]
+}
+
+// close stops collecting and returns the collected packets. The
+// later replies are sent immediately.
+func (o *packetOut) close() (msgs []outPacket) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.open = false
+	return o.msgs
+}
+
+func releaseOutPackets(msgs []outPacket) {
+	for i := range msgs {
+		bufpool.Put(msgs[i].data)
+		msgs[i] = outPacket{}
+	}
+}
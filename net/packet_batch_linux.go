@@ -0,0 +1,294 @@
+//go:build linux && !386
+
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/hedzr/go-socketlib/net/bufpool"
+)
+
+// servePacketsBatched reads the packets by recvmmsg and sends the
+// replies by sendmmsg. It falls back to servePackets if pc is not a
+// system socket.
+func (s *serverWrap) servePacketsBatched(ctx context.Context, pc net.PacketConn) (err error) {
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return s.servePackets(ctx, pc)
+	}
+	var rc syscall.RawConn
+	if rc, err = sc.SyscallConn(); err != nil {
+		return s.servePackets(ctx, pc)
+	}
+
+	b := newPacketBatch(rc, s.pktBatch, s.bufferSize*2)
+	defer b.release()
+	process, _ := s.processors(s.handler)
+	out := &packetOut{}
+	s.Debug("[serverWrap] batched packet loop", "batch", s.pktBatch, "family", b.family)
+
+	for {
+		var n int
+		if n, err = b.recv(); err != nil {
+			if s.IsExited() {
+				err = nil
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		out.reset()
+		for i := 0; i < n; i++ {
+			s.handlePacket(ctx, pc, b.addr(i, s.network), b.data(i), out, process)
+		}
+		if msgs := out.close(); len(msgs) > 0 {
+			sent, e := b.send(msgs)
+			if e != nil {
+				s.Verbose("[serverWrap] sendmmsg failed, fallback to WriteTo", "err", e, "sent", sent)
+				for _, m := range msgs[sent:] {
+					if _, e = pc.WriteTo(m.data, m.addr); e != nil {
+						s.handleError(e, "[serverWrap] write packet failed", "remote.addr", m.addr)
+					}
+				}
+			}
+			releaseOutPackets(msgs)
+		}
+	}
+}
+
+// mmsghdr is struct mmsghdr of linux.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	n   uint32
+}
+
+// packetBatch holds the buffers for recvmmsg and sendmmsg.
+type packetBatch struct {
+	rc     syscall.RawConn
+	family int // the address family of socket
+
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+	bufs  [][]byte
+
+	outHdrs  []mmsghdr
+	outIovs  []syscall.Iovec
+	outNames []syscall.RawSockaddrAny
+}
+
+func newPacketBatch(rc syscall.RawConn, size, bufSize int) *packetBatch {
+	b := &packetBatch{
+		rc:       rc,
+		hdrs:     make([]mmsghdr, size),
+		iovs:     make([]syscall.Iovec, size),
+		names:    make([]syscall.RawSockaddrAny, size),
+		bufs:     make([][]byte, size),
+		outHdrs:  make([]mmsghdr, size),
+		outIovs:  make([]syscall.Iovec, size),
+		outNames: make([]syscall.RawSockaddrAny, size),
+	}
+	for i := range b.hdrs {
+		b.bufs[i] = bufpool.Get(bufSize)
+		b.iovs[i].Base = &b.bufs[i][0]
+		b.iovs[i].SetLen(bufSize)
+		b.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		b.hdrs[i].hdr.Iov = &b.iovs[i]
+		b.hdrs[i].hdr.Iovlen = 1
+		b.outHdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&b.outNames[i]))
+		b.outHdrs[i].hdr.Iov = &b.outIovs[i]
+		b.outHdrs[i].hdr.Iovlen = 1
+	}
+	_ = rc.Control(func(fd uintptr) {
+		if sa, err := syscall.Getsockname(int(fd)); err == nil {
+			switch sa.(type) {
+			case *syscall.SockaddrInet4:
+				b.family = syscall.AF_INET
+			case *syscall.SockaddrInet6:
+				b.family = syscall.AF_INET6
+			case *syscall.SockaddrUnix:
+				b.family = syscall.AF_UNIX
+			}
+		}
+	})
+	return b
+}
+
+func (b *packetBatch) release() {
+	for i := range b.bufs {
+		bufpool.Put(b.bufs[i])
+		b.bufs[i] = nil
+	}
+}
+
+// recv blocks till some packets arrived, and returns the count of
+// them.
+func (b *packetBatch) recv() (n int, err error) {
+	for i := range b.hdrs {
+		b.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+		b.hdrs[i].hdr.Flags = 0
+		b.hdrs[i].n = 0
+	}
+
+	var errno syscall.Errno
+	err = b.rc.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd,
+			uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(len(b.hdrs)), 0, 0, 0)
+		if e == syscall.EAGAIN || e == syscall.EINTR {
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	if err == nil && errno != 0 {
+		n, err = 0, os.NewSyscallError("recvmmsg", errno)
+	}
+	return
+}
+
+func (b *packetBatch) data(i int) []byte { return b.bufs[i][:b.hdrs[i].n] }
+
+func (b *packetBatch) addr(i int, network string) net.Addr {
+	return sockaddrToAddr(&b.names[i], b.hdrs[i].hdr.Namelen, network)
+}
+
+// send sends msgs by sendmmsg, and returns the count of sent packets.
+func (b *packetBatch) send(msgs []outPacket) (sent int, err error) {
+	for sent < len(msgs) {
+		cnt := min(len(msgs)-sent, len(b.outHdrs))
+		for i := 0; i < cnt; i++ {
+			m := &msgs[sent+i]
+			l, ok := addrToSockaddr(m.addr, b.family, &b.outNames[i])
+			if !ok {
+				if i == 0 {
+					return sent, errUnsupportedAddr
+				}
+				cnt = i
+				break
+			}
+			b.outHdrs[i].hdr.Namelen = l
+			b.outIovs[i].Base = &m.data[0]
+			b.outIovs[i].SetLen(len(m.data))
+		}
+
+		var r int
+		var errno syscall.Errno
+		err = b.rc.Write(func(fd uintptr) bool {
+			n, _, e := syscall.Syscall6(sysSendmmsg, fd,
+				uintptr(unsafe.Pointer(&b.outHdrs[0])), uintptr(cnt), 0, 0, 0)
+			if e == syscall.EAGAIN || e == syscall.EINTR {
+				return false
+			}
+			r, errno = int(n), e
+			return true
+		})
+		if err == nil && errno != 0 {
+			err = os.NewSyscallError("sendmmsg", errno)
+		}
+		if err != nil {
+			return
+		}
+		sent += r
+	}
+	return
+}
+
+var errUnsupportedAddr = errors.New("unsupported address for sendmmsg")
+
+func sockaddrToAddr(rsa *syscall.RawSockaddrAny, l uint32, network string) net.Addr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return &net.UDPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: int(p[0])<<8 | int(p[1])}
+
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		var zone string
+		if sa.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+				zone = ifi.Name
+			} else {
+				zone = strconv.Itoa(int(sa.Scope_id))
+			}
+		}
+		return &net.UDPAddr{IP: ip, Port: int(p[0])<<8 | int(p[1]), Zone: zone}
+
+	case syscall.AF_UNIX:
+		sa := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		n := int(l) - 2 // sizeof(sa_family_t)
+		if n <= 0 {
+			return nil // unnamed socket
+		}
+		path := unsafe.Slice((*byte)(unsafe.Pointer(&sa.Path[0])), n)
+		if path[0] == 0 { // abstract namespace
+			path[0] = '@'
+		} else {
+			for i, c := range path {
+				if c == 0 {
+					path = path[:i]
+					break
+				}
+			}
+		}
+		return &net.UnixAddr{Name: string(path), Net: network}
+	}
+	return nil
+}
+
+func addrToSockaddr(addr net.Addr, family int, rsa *syscall.RawSockaddrAny) (l uint32, ok bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		if ip4 := a.IP.To4(); ip4 != nil && family == syscall.AF_INET {
+			sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+			*sa = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+			p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+			p[0], p[1] = byte(a.Port>>8), byte(a.Port)
+			copy(sa.Addr[:], ip4)
+			return syscall.SizeofSockaddrInet4, true
+		}
+		if ip6 := a.IP.To16(); ip6 != nil && family == syscall.AF_INET6 {
+			sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+			*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+			p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+			p[0], p[1] = byte(a.Port>>8), byte(a.Port)
+			copy(sa.Addr[:], ip6)
+			if a.Zone != "" {
+				if ifi, err := net.InterfaceByName(a.Zone); err == nil {
+					sa.Scope_id = uint32(ifi.Index)
+				} else if id, err := strconv.Atoi(a.Zone); err == nil {
+					sa.Scope_id = uint32(id)
+				}
+			}
+			return syscall.SizeofSockaddrInet6, true
+		}
+
+	case *net.UnixAddr:
+		sa := (*syscall.RawSockaddrUnix)(unsafe.Pointer(rsa))
+		if n := len(a.Name); n > 0 && n < len(sa.Path) && family == syscall.AF_UNIX {
+			*sa = syscall.RawSockaddrUnix{Family: syscall.AF_UNIX}
+			path := unsafe.Slice((*byte)(unsafe.Pointer(&sa.Path[0])), len(sa.Path))
+			copy(path, a.Name)
+			if path[0] == '@' { // abstract namespace
+				path[0] = 0
+				return uint32(2 + n), true
+			}
+			return uint32(2 + n + 1), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,5 @@
+package net
+
+// sysSendmmsg is the number of sendmmsg, which is missing in the
+// syscall package of linux/amd64.
+const sysSendmmsg = 307
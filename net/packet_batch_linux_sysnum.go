@@ -0,0 +1,7 @@
+//go:build linux && !386 && !amd64
+
+package net
+
+import "syscall"
+
+const sysSendmmsg = syscall.SYS_SENDMMSG
@@ -0,0 +1,14 @@
+//go:build !linux || 386
+
+package net
+
+import (
+	"context"
+	"net"
+)
+
+// servePacketsBatched falls back to servePackets on the platforms
+// without recvmmsg and sendmmsg.
+func (s *serverWrap) servePacketsBatched(ctx context.Context, pc net.PacketConn) (err error) {
+	return s.servePackets(ctx, pc)
+}
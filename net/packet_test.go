@@ -0,0 +1,73 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	stdnet "net"
+	"testing"
+	"time"
+)
+
+// startTestPacketServer starts an udp server at a random port of
+// loopback interface and returns its listening address.
+func startTestPacketServer(t *testing.T, opts ...ServerOpt) (addr string) {
+	t.Helper()
+	pc, err := stdnet.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = pc.LocalAddr().String()
+	_ = pc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewServer(addr, append([]ServerOpt{
+		WithNetwork("udp"),
+		WithServerQuiet(true),
+		WithServerLogger(testLogger()),
+	}, opts...)...)
+	if err = s.Start(ctx); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		_ = s.Stop()
+	})
+	return
+}
+
+func TestServer_packetEcho(t *testing.T) {
+	for _, batch := range []int{0, 8} {
+		t.Run(fmt.Sprintf("batch-%d", batch), func(t *testing.T) {
+			addr := startTestPacketServer(t,
+				WithServerPacketBatch(batch),
+				WithServerOnProcessData(echoProcessor),
+			)
+
+			conn, err := stdnet.Dial("udp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			const count = 32
+			for i := 0; i < count; i++ {
+				if _, err = fmt.Fprintf(conn, "packet %d", i); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 1024)
+			for i := 0; i < count; i++ {
+				n, err := conn.Read(buf)
+				if err != nil {
+					t.Fatalf("packet %d: %v", i, err)
+				}
+				if got, expect := string(buf[:n]), fmt.Sprintf("packet %d", i); got != expect {
+					t.Fatalf("expect %q, but got %q", expect, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package net
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// peerCred returns the credentials of the peer process of a unix
+// domain socket.
+func peerCred(conn net.Conn) (cred api.PeerCred, err error) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return cred, api.ErrPeerCredUnsupported
+	}
+	var rc syscall.RawConn
+	if rc, err = uc.SyscallConn(); err != nil {
+		return
+	}
+	var ucred *syscall.Ucred
+	var e error
+	if err = rc.Control(func(fd uintptr) {
+		ucred, e = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err == nil {
+		err = e
+	}
+	if err == nil {
+		cred = api.PeerCred{PID: int(ucred.Pid), UID: int(ucred.Uid), GID: int(ucred.Gid)}
+	}
+	return
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package net
+
+import (
+	"net"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func peerCred(conn net.Conn) (cred api.PeerCred, err error) {
+	return cred, api.ErrPeerCredUnsupported
+}
@@ -3,63 +3,59 @@ package pi
 import (
 	"bytes"
 	"encoding/binary"
-	"sync"
+
+	"github.com/hedzr/go-socketlib/net/bufpool"
 )
 
 const maxPackageSize = 65536
-const initialBufferSize = 4096
 
 func NewLeadBytes(leadingMagics []byte) *leadBytesS {
 	s := &leadBytesS{
 		leadingMagics: leadingMagics,
-		// decodeCache:   poolLeadByteDecode.Get().([]byte),
-		// encodeCache:   poolLeadByteEncode.Get().([]byte),
 	}
 	return s
 }
 
-var poolLeadByteDecode = sync.Pool{New: func() any { return make([]byte, 0, initialBufferSize) }}
-var poolLeadByteEncode = sync.Pool{New: func() any { return make([]byte, 0, initialBufferSize) }}
-
 type leadBytesS struct {
 	leadingMagics []byte
-	decodeCache   []byte
-	encodeCache   []byte
 }
 
+// OnEncode returns a pooled buffer of the encoded package. The
+// caller owns it and may give it back by bufpool.Put after the
+// package was sent.
 func (s *leadBytesS) OnEncode(body []byte) (data []byte, err error) {
 	if ld := len(body); ld > 0 {
-		defer poolLeadByteDecode.Put(s.decodeCache)
 		l := len(s.leadingMagics)
-		s.encodeCache = poolLeadByteEncode.Get().([]byte)[:l]
-		copy(s.encodeCache, s.leadingMagics)
-		s.encodeCache = binary.AppendVarint(s.encodeCache, int64(ld))
-		s.encodeCache = append(s.encodeCache, body...)
-		data = s.encodeCache
+		data = bufpool.Get(l + binary.MaxVarintLen64 + ld)[:l]
+		copy(data, s.leadingMagics)
+		data = binary.AppendVarint(data, int64(ld))
+		data = append(data, body...)
 	}
 	return
 }
 
+// OnDecode sends each decoded package to ch as a bufpool.Frame
+// converted to []byte. The receiver owns it and should call
+// bufpool.Frame(pkg).Release() once done.
 func (s *leadBytesS) OnDecode(data []byte, ch chan<- []byte) (processed bool, err error) {
 	if ld := len(data); ld > 0 {
-		defer poolLeadByteDecode.Put(s.decodeCache)
-		s.decodeCache = append(poolLeadByteDecode.Get().([]byte)[:0], data...)
-		cacheLen := len(s.decodeCache)
+		cache := data
+		cacheLen := len(cache)
 		if l := len(s.leadingMagics); cacheLen > l {
 		nextPackage:
-			if bytes.Compare(s.leadingMagics, s.decodeCache[:l]) == 0 {
+			if len(cache) > l && bytes.Equal(s.leadingMagics, cache[:l]) {
 				var length int64
 				var ate int
-				length, ate = binary.Varint(s.decodeCache[l:])
+				length, ate = binary.Varint(cache[l:])
 				if ate > 0 && length < maxPackageSize {
 					processed = true
 					begin := l + ate
 					end := int(length) + begin
-					if end <= cacheLen {
+					if end <= len(cache) {
 						if ch != nil {
-							ch <- s.decodeCache[begin:end]
+							ch <- bufpool.Clone(cache[begin:end])
 						}
-						s.decodeCache = s.decodeCache[end:]
+						cache = cache[end:]
 						goto nextPackage
 					}
 				}
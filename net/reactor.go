@@ -0,0 +1,169 @@
+package net
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hedzr/go-socketlib/net/bufpool"
+)
+
+// reactor is the event-loop (epoll) I/O engine. In reactor mode, a
+// fixed pool of pollers waits for the readiness of connections and
+// runs the same processing callbacks as the goroutine mode, so that
+// an idle connection costs no goroutine and no reading buffer.
+type reactor interface {
+	// add registers c into one of pollers. c.ev is set before c
+	// can be polled.
+	add(c *connS) (err error)
+	// close closes all registered connections and stops the pollers.
+	close()
+}
+
+// evPoller is the poller which a connection was registered into.
+type evPoller interface {
+	rearm(fd int) error
+	remove(fd int)
+}
+
+// evState is the reactor-mode state of a connection.
+type evState struct {
+	poller evPoller
+	rc     syscall.RawConn
+	fd     int
+	buf    []byte // the reading buffer, nil while idle
+	pos    int
+}
+
+var errReactorUnsupported = errors.New("reactor mode unsupported for this connection")
+
+// WithServerReactor enables the event-loop (epoll) I/O mode, which
+// is available on Linux for plain tcp and unix connections.
+//
+// In this mode, pollers goroutines wait for the readiness of all
+// connections and invoke OnProcessData, Handler and interceptors as
+// usual, instead of two goroutines per connection. The cached
+// writing queue is flushed by a short-lived goroutine only while it
+// is not empty. The connections that cannot be polled, such as tls
+// connections, fall back to the goroutine mode.
+//
+// pollers is the count of polling goroutines, 0 means the number
+// of CPUs.
+func WithServerReactor(pollers int) ServerOpt {
+	return func(s *serverWrap) {
+		s.evEnabled, s.evPollers = true, pollers
+	}
+}
+
+// detach hands the connection over to the reactor. It returns false
+// if the connection should be served in goroutine mode.
+func (s *connS) detach() bool {
+	if s.reactor == nil {
+		return false
+	}
+	if _, ok := s.conn.Load().(syscall.Conn); !ok {
+		return false
+	}
+
+	atomic.StoreInt32(&s.evMode, 1)
+	if err := s.reactor.add(s); err != nil {
+		atomic.StoreInt32(&s.evMode, 0)
+		s.Warn("[connS] cannot be polled by reactor, fallback to goroutine mode", "client.addr", s.RemoteAddrString(), "err", err)
+		return false
+	}
+	s.kickWriter() // flush the messages cached before detaching
+	return true
+}
+
+func (s *connS) inReactor() bool { return atomic.LoadInt32(&s.evMode) == 1 }
+
+// onReadable is called by a poller after the connection became
+// readable. It returns false if the connection has been closed.
+func (s *connS) onReadable() (keep bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			keep = false
+			s.onPanic("reactor", v)
+		}
+	}()
+	ev := s.ev
+	if s.connCtx().Err() != nil {
+		s.Close()
+		return false
+	}
+	if ev.buf == nil {
+		ev.buf = bufpool.Get(s.bufferSize * 2)
+	}
+
+	n, again, err := evRead(ev.rc, ev.buf[ev.pos:ev.pos+s.bufferSize])
+	if err == nil && !again && n == 0 {
+		err = io.EOF
+	}
+	if err != nil {
+		s.handleReadError(n, err, ev.buf, ev.pos, s, s)
+		if errors.Is(err, io.EOF) {
+			bufpool.Put(ev.buf)
+			ev.buf = nil
+			s.readEnded() // not polled any more, the writing goes on
+		} else {
+			s.Close()
+		}
+		return false
+	}
+
+	if n > 0 {
+		var ok bool
+		if ev.pos, ok = s.dispatch(ev.buf, ev.pos, n, s, s); !ok {
+			s.Close()
+			return false
+		}
+	}
+	if ev.pos == 0 || s.Closed() {
+		bufpool.Put(ev.buf)
+		ev.buf = nil
+	}
+	return s.NotClosed()
+}
+
+// closeInReactor settles the cached writing and invokes the
+// disconnected callbacks, after the connection was unregistered from
+// its poller and closed.
+func (s *connS) closeInReactor() {
+	s.wq.discard(net.ErrClosed)
+	s.tryInvokeOnClientDisconnected(s, s)
+}
+
+// kickWriter starts a short-lived writing goroutine in reactor mode.
+// The goroutine exits once the writing queue drained.
+func (s *connS) kickWriter() {
+	if s.inReactor() && atomic.CompareAndSwapInt32(&s.flushing, 0, 1) {
+		go s.flushQueue()
+	}
+}
+
+func (s *connS) flushQueue() {
+	defer s.recoverPanic("flushQueue")
+	for {
+	drainLoop:
+		for {
+			select {
+			case req := <-s.wq.ch:
+				batch := s.wq.drain(req, s.wbSize, s.wbDelay)
+				if err := writeBatch(s.connCtx(), s.protocolInterceptor, s, batch, s.rawWriteBuffers); err != nil {
+					s.handleError(err, "[connS] Write failed")
+					s.Close()
+					return
+				}
+			default:
+				break drainLoop
+			}
+		}
+
+		atomic.StoreInt32(&s.flushing, 0)
+		if s.wq.Len() == 0 || !atomic.CompareAndSwapInt32(&s.flushing, 0, 1) {
+			return
+		}
+	}
+}
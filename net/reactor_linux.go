@@ -0,0 +1,205 @@
+//go:build linux
+
+package net
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// epollReactor spreads the connections over a fixed pool of epoll
+// pollers.
+type epollReactor struct {
+	pollers []*epoller
+	next    uint32
+	once    sync.Once
+}
+
+func newReactor(s *serverWrap, pollers int) (reactor, error) {
+	if pollers <= 0 {
+		pollers = runtime.NumCPU()
+	}
+	r := &epollReactor{}
+	for i := 0; i < pollers; i++ {
+		p, err := newEpoller()
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		r.pollers = append(r.pollers, p)
+		go p.loop()
+	}
+	s.Debug("[reactor] started", "pollers", pollers)
+	return r, nil
+}
+
+func (r *epollReactor) add(c *connS) (err error) {
+	sc, ok := c.conn.Load().(syscall.Conn)
+	if !ok {
+		return errReactorUnsupported
+	}
+	var rc syscall.RawConn
+	if rc, err = sc.SyscallConn(); err != nil {
+		return
+	}
+	var fd int
+	if err = rc.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return
+	}
+	p := r.pollers[atomic.AddUint32(&r.next, 1)%uint32(len(r.pollers))]
+	return p.add(c, rc, fd)
+}
+
+func (r *epollReactor) close() {
+	r.once.Do(func() {
+		for _, p := range r.pollers {
+			p.close()
+		}
+	})
+}
+
+// evFlags arms a connection for one readable event. A poller rearms
+// it after the event handled, so a connection is never processed by
+// two goroutines at the same time.
+const evFlags = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+type epoller struct {
+	epfd   int
+	wake   [2]int // the pipe to wake up epoll_wait for closing
+	mu     sync.Mutex
+	conns  map[int]*connS
+	closed bool
+}
+
+func newEpoller() (p *epoller, err error) {
+	p = &epoller{conns: make(map[int]*connS)}
+	if p.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	if err = syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		_ = syscall.Close(p.epfd)
+		return nil, os.NewSyscallError("pipe2", err)
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wake[0])}
+	if err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, p.wake[0], &ev); err != nil {
+		p.release()
+		return nil, os.NewSyscallError("epoll_ctl", err)
+	}
+	return
+}
+
+func (p *epoller) add(c *connS, rc syscall.RawConn, fd int) (err error) {
+	c.ev = &evState{poller: p, rc: rc, fd: fd}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return net.ErrClosed
+	}
+	p.conns[fd] = c
+	p.mu.Unlock()
+
+	ev := syscall.EpollEvent{Events: evFlags, Fd: int32(fd)}
+	if err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		p.mu.Lock()
+		delete(p.conns, fd)
+		p.mu.Unlock()
+		c.ev = nil
+		err = os.NewSyscallError("epoll_ctl", err)
+	}
+	return
+}
+
+func (p *epoller) rearm(fd int) error {
+	ev := syscall.EpollEvent{Events: evFlags, Fd: int32(fd)}
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, fd, &ev)
+}
+
+func (p *epoller) remove(fd int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.conns[fd]; ok {
+		delete(p.conns, fd)
+		_ = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+	}
+}
+
+func (p *epoller) lookup(fd int) *connS {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conns[fd]
+}
+
+func (p *epoller) loop() {
+	defer p.release()
+	events := make([]syscall.EpollEvent, 256)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			return
+		}
+		for i := 0; i < n; i++ {
+			fd := int(events[i].Fd)
+			if fd == p.wake[0] {
+				return
+			}
+			if c := p.lookup(fd); c != nil && c.onReadable() {
+				_ = p.rearm(fd)
+			}
+		}
+	}
+}
+
+// close closes all connections of the poller, and stops the loop.
+func (p *epoller) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	conns := make([]*connS, 0, len(p.conns))
+	for _, c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	_, _ = syscall.Write(p.wake[1], []byte{0})
+}
+
+func (p *epoller) release() {
+	_ = syscall.Close(p.wake[0])
+	_ = syscall.Close(p.wake[1])
+	_ = syscall.Close(p.epfd)
+}
+
+// evRead reads the connection once without blocking. again is true
+// if nothing to read for now.
+func evRead(rc syscall.RawConn, p []byte) (n int, again bool, err error) {
+	var sysErr error
+	err = rc.Read(func(fd uintptr) bool {
+		n, sysErr = syscall.Read(int(fd), p)
+		return true
+	})
+	if err == nil {
+		err = sysErr
+	}
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+		return 0, true, nil
+	}
+	if n < 0 {
+		n = 0
+	}
+	return
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package net
+
+import (
+	stdnet "net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func TestServer_reactor(t *testing.T) {
+	var connected, disconnected int32
+	addr, s := startTestServer(t,
+		WithServerReactor(2),
+		WithServerOnProcessData(echoProcessor),
+		WithServerOnClientConnected(func(w api.Response, ss Server) {
+			if atomic.AddInt32(&connected, 1) == 1 {
+				_, _ = w.Write([]byte("welcome\n"))
+			}
+		}),
+		WithServerOnClientDisconnected(func(w api.Response, r api.Request, ss Server) {
+			atomic.AddInt32(&disconnected, 1)
+		}),
+	)
+	if s.reactor == nil {
+		t.Fatal("expect reactor mode enabled")
+	}
+
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "welcome\n" {
+		t.Fatalf("expect welcome message, but got %q, %v", buf[:n], err)
+	}
+	_ = conn.Close()
+
+	testEcho(t, addr, 50)
+
+	for i := 0; i < 100 && atomic.LoadInt32(&disconnected) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&disconnected); n != 2 {
+		t.Fatalf("expect 2 disconnected connections, but got %d", n)
+	}
+}
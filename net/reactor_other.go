@@ -0,0 +1,15 @@
+//go:build !linux
+
+package net
+
+import (
+	"syscall"
+)
+
+func newReactor(s *serverWrap, pollers int) (reactor, error) {
+	return nil, errUnimplemented
+}
+
+func evRead(rc syscall.RawConn, p []byte) (n int, again bool, err error) {
+	return 0, false, errReactorUnsupported
+}
@@ -0,0 +1,71 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/hedzr/is"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// PanicError is the error reported to api.ErrorAware after a panic
+// recovered from a connection goroutine.
+type PanicError struct {
+	Value any    // the value passed to panic
+	Stack []byte // the stack of the panicking goroutine
+	Where string // which goroutine panicked
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("panic in %s: %v", e.Where, e.Value) }
+
+// WithServerRepanicInDebug makes the connection goroutines re-panic
+// after a panic recovered and logged, if the binary is a debug build
+// (with the 'delve' build tag). It helps to break into the debugger
+// at the bug.
+//
+// Otherwise, a panic in OnProcessData, Handler.Serve or interceptors
+// closes its connection only.
+func WithServerRepanicInDebug(b bool) ServerOpt {
+	return func(s *serverWrap) {
+		s.repanic = b
+	}
+}
+
+// recoverPanic recovers a panic of the connection goroutine, and
+// closes the connection. It must be deferred directly.
+func (s *connS) recoverPanic(where string) {
+	if v := recover(); v != nil {
+		s.onPanic(where, v)
+	}
+}
+
+// onPanic logs the recovered panic with the stack, reports it, and
+// closes the connection.
+func (s *connS) onPanic(where string, v any) {
+	err := &PanicError{Value: v, Stack: debug.Stack(), Where: where}
+	s.reportPanic(s.connCtx(), err, s, "client.addr", s.RemoteAddrString(), "client.id", s.GetClientID())
+	s.Close()
+	if s.repanic && is.DebugBuild() {
+		panic(v)
+	}
+}
+
+// reportPanic logs err with the connection attributes, and reports
+// it to the api.ErrorAware interceptor and handler.
+func (s *serverWrap) reportPanic(ctx context.Context, err *PanicError, conn api.Conn, args ...any) {
+	s.Error("[serverWrap] panic recovered", append(args, "where", err.Where, "panic", err.Value, "stack", string(err.Stack))...)
+
+	defer func() {
+		if v := recover(); v != nil {
+			s.Error("[serverWrap] panic in OnError", "panic", v)
+		}
+	}()
+	if ea, ok := s.protocolInterceptor.(api.ErrorAware); ok {
+		ea.OnError(ctx, conn, err)
+	}
+	if ea, ok := s.handler.(api.ErrorAware); ok {
+		ea.OnError(ctx, conn, err)
+	}
+}
@@ -0,0 +1,56 @@
+package net
+
+import (
+	"context"
+	"errors"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+type errorAwareHandler chan error
+
+func (h errorAwareHandler) Serve(ctx context.Context, w api.Response, r api.Request) (processed bool, err error) {
+	return
+}
+
+func (h errorAwareHandler) OnError(ctx context.Context, conn api.Conn, err error) { h <- err }
+
+func TestServer_recoverPanic(t *testing.T) {
+	h := make(errorAwareHandler, 1)
+	addr, _ := startTestServer(t,
+		WithServerHandler(h),
+		WithServerOnProcessData(func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+			if string(data) == "boom\n" {
+				panic("boom")
+			}
+			return echoProcessor(data, w, r)
+		}),
+	)
+
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("boom\n"))
+
+	select {
+	case err = <-h:
+		var pe *PanicError
+		if !errors.As(err, &pe) || pe.Value != "boom" || len(pe.Stack) == 0 {
+			t.Fatalf("expect a PanicError, but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic not reported")
+	}
+
+	// only the panicking connection was closed
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 8)); err == nil {
+		t.Fatal("expect the connection closed")
+	}
+	testEcho(t, addr, 3)
+}
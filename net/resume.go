@@ -0,0 +1,536 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResumeRetained = 256 * 1024
+	resumeLineMax         = 128
+)
+
+var errResumeHandshake = errors.New("bad resumption handshake")
+
+// WithServerResumption enables the session resumption for the clients
+// with WithClientResumption. Each connection begins with a handshake,
+// by which the server issues a token, or re-binds the Session of the
+// token presented by a reconnecting client.
+//
+// After a connection lost, its Session and the messages still queued
+// are kept for window. A client resuming within window gets the bytes
+// it missed replayed, then the queued messages, and the session goes
+// on. Up to maxRetained bytes, 256KB if maxRetained <= 0, sent within
+// window are retained per session for the replay.
+//
+// The handshake is a line in each direction, before anything else
+// but the authentication of WithServerAuthenticator:
+//
+//	client: RESUME <token, or "-" for a new session> <bytes received>\n
+//	server: SESSION <token> <offset of the replay>\n
+//
+// The connections are not polled by the reactor, and StartTLS is
+// unsupported on them.
+func WithServerResumption(window time.Duration, maxRetained int) ServerOpt {
+	return func(s *serverWrap) {
+		if window > 0 {
+			s.resumer = newResumer(window, maxRetained)
+		}
+	}
+}
+
+// resumer keeps the resumable sessions of a server.
+type resumer struct {
+	window   time.Duration
+	limit    int // max bytes retained per session
+	mu       sync.Mutex
+	sessions map[string]*resumable
+	closed   bool
+}
+
+func newResumer(window time.Duration, limit int) *resumer {
+	if limit <= 0 {
+		limit = defaultResumeRetained
+	}
+	return &resumer{window: window, limit: limit, sessions: make(map[string]*resumable)}
+}
+
+// resumable is a session which can be resumed by its token.
+type resumable struct {
+	rs        *resumer
+	token     string
+	sess      *Session
+	principal *Principal // the authenticated owner, nil without WithServerAuthenticator
+	mu        sync.Mutex
+	owner     *connS      // nil while detached
+	prev      *connS      // the last owner, which hands its queue over after its writing loop stopped
+	chunks    []retained  // the bytes sent but not acknowledged
+	head      uint64      // the offset of chunks[0]
+	sent      uint64      // the offset after the last byte sent
+	unsent    []*writeReq // the messages queued while the connection lost
+	timer     *time.Timer // expires the detached session
+	gen       int         // bumped on each detaching, for the stale timers
+	dropped   bool
+}
+
+type retained struct {
+	data []byte
+	at   time.Time
+}
+
+// issue registers a new resumable session owned by c.
+func (rs *resumer) issue(c *connS) (r *resumable, err error) {
+	var b [16]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return
+	}
+	r = &resumable{rs: rs, token: hex.EncodeToString(b[:]), sess: c.sess, principal: c.principal, owner: c}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.closed {
+		return nil, net.ErrClosed
+	}
+	rs.sessions[r.token] = r
+	return
+}
+
+// resume re-binds the session of token to c. It returns the bytes to
+// replay from offset, and the messages queued while detached.
+//
+// r is nil if the session is unknown, expired, cannot be replayed
+// from offset, or belongs to another principal.
+func (rs *resumer) resume(c *connS, token string, offset uint64) (r *resumable, replay []byte, unsent []*writeReq) {
+	rs.mu.Lock()
+	r = rs.sessions[token]
+	rs.mu.Unlock()
+	if r == nil {
+		return
+	}
+	if !samePrincipal(r.principal, c.principal) {
+		c.Warn("[connS] session of another principal refused")
+		return nil, nil, nil
+	}
+
+	r.mu.Lock()
+	old := r.owner
+	r.mu.Unlock()
+	if old != nil {
+		old.Close() // the client reconnected before the loss detected, it detaches the session
+	}
+	r.mu.Lock()
+	prev := r.prev
+	r.mu.Unlock()
+	if prev != nil {
+		prev.hj.waitWriter() // till its queue handed over
+	}
+
+	r.mu.Lock()
+	if r.dropped || r.owner != nil {
+		r.mu.Unlock()
+		return nil, nil, nil // expired, or taken by another connection
+	}
+	if offset < r.head || offset > r.sent {
+		r.mu.Unlock()
+		rs.drop(r) // the client has lost some bytes for good
+		return nil, nil, nil
+	}
+	r.timer.Stop()
+	r.owner, r.prev = c, nil
+	replay = r.since(offset)
+	unsent, r.unsent = r.unsent, nil
+	r.mu.Unlock()
+	return
+}
+
+// samePrincipal tells whether a and b are the same authenticated
+// identity.
+func samePrincipal(a, b *Principal) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Name == b.Name && a.Mechanism == b.Mechanism
+}
+
+// since returns a copy of the bytes from offset, and forgets the
+// chunks acknowledged. It must be called with r.mu locked.
+func (r *resumable) since(offset uint64) (replay []byte) {
+	skip := offset - r.head
+	var i int
+	for ; i < len(r.chunks) && skip >= uint64(len(r.chunks[i].data)); i++ {
+		skip -= uint64(len(r.chunks[i].data))
+		r.head += uint64(len(r.chunks[i].data))
+	}
+	r.chunks = slices.Delete(r.chunks, 0, i)
+	for _, c := range r.chunks {
+		replay = append(replay, c.data[skip:]...)
+		skip = 0
+	}
+	return
+}
+
+// record retains the bytes being sent, and forgets the ones out of
+// the window or the limit.
+func (r *resumable) record(bufs ...[]byte) {
+	var size int
+	for _, b := range bufs {
+		size += len(b)
+	}
+	if size == 0 {
+		return
+	}
+	data := make([]byte, 0, size)
+	for _, b := range bufs {
+		data = append(data, b...)
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dropped {
+		return
+	}
+	r.chunks = append(r.chunks, retained{data: data, at: now})
+	r.sent += uint64(size)
+	var i int
+	for ; i < len(r.chunks); i++ {
+		if r.sent-r.head <= uint64(r.rs.limit) && now.Sub(r.chunks[i].at) <= r.rs.window {
+			break
+		}
+		r.head += uint64(len(r.chunks[i].data))
+	}
+	r.chunks = slices.Delete(r.chunks, 0, i)
+}
+
+// detach keeps the session of c for the window after its connection
+// closed, together with the messages still queued.
+//
+// The writing loop of c may be draining the queue, so it hands the
+// rest over by handOff after it stopped.
+func (rs *resumer) detach(c *connS) {
+	r := c.rs
+	c.hj.mu.Lock()
+	looping := c.hj.looping
+	c.hj.mu.Unlock()
+	var unsent []*writeReq
+	if !looping {
+		c.wl.Lock() // wait for the writing in flight, the later ones see the connection closed
+		c.wl.Unlock()
+		unsent = c.wq.takeAll()
+	}
+
+	rs.mu.Lock()
+	closed := rs.closed
+	rs.mu.Unlock()
+
+	r.mu.Lock()
+	if closed || r.dropped || r.owner != c {
+		r.mu.Unlock()
+		for _, req := range unsent {
+			req.resolve(0, net.ErrClosed)
+		}
+		if closed {
+			rs.drop(r)
+		}
+		return
+	}
+	r.owner, r.prev = nil, c
+	r.unsent = append(r.unsent, unsent...)
+	r.gen++
+	gen := r.gen
+	r.timer = time.AfterFunc(rs.window, func() { rs.expire(r, gen) })
+	r.mu.Unlock()
+	c.Debug("[connS] session detached, waiting for resuming", "window", rs.window, "queued", len(unsent))
+}
+
+// handOff moves the messages left in the queue of c to its detached
+// session. It is called after the writing loop of c stopped.
+func (rs *resumer) handOff(c *connS) {
+	r := c.rs
+	unsent := c.wq.takeAll()
+	r.mu.Lock()
+	if !r.dropped && r.owner == nil && r.prev == c {
+		r.unsent, unsent = append(r.unsent, unsent...), nil
+	}
+	r.mu.Unlock()
+	for _, req := range unsent {
+		req.resolve(0, net.ErrClosed)
+	}
+}
+
+// expire drops the session if it has not been resumed since the
+// detaching of gen.
+func (rs *resumer) expire(r *resumable, gen int) {
+	r.mu.Lock()
+	stale := r.owner != nil || r.gen != gen
+	r.mu.Unlock()
+	if !stale {
+		rs.drop(r)
+	}
+}
+
+// drop forgets the session, and closes it.
+func (rs *resumer) drop(r *resumable) {
+	rs.mu.Lock()
+	if rs.sessions[r.token] == r {
+		delete(rs.sessions, r.token)
+	}
+	rs.mu.Unlock()
+
+	r.mu.Lock()
+	if r.dropped {
+		r.mu.Unlock()
+		return
+	}
+	r.dropped = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	unsent := r.unsent
+	r.chunks, r.unsent, r.prev = nil, nil, nil
+	r.mu.Unlock()
+
+	for _, req := range unsent {
+		req.resolve(0, net.ErrClosed)
+	}
+	r.sess.close()
+}
+
+// close drops the detached sessions. The others are dropped while
+// their connections closing.
+func (rs *resumer) close() {
+	rs.mu.Lock()
+	rs.closed = true
+	all := make([]*resumable, 0, len(rs.sessions))
+	for _, r := range rs.sessions {
+		all = append(all, r)
+	}
+	rs.mu.Unlock()
+
+	for _, r := range all {
+		r.mu.Lock()
+		detached := r.owner == nil
+		r.mu.Unlock()
+		if detached {
+			rs.drop(r)
+		}
+	}
+}
+
+// reopen accepts the sessions again after the server restarted.
+func (rs *resumer) reopen() {
+	rs.mu.Lock()
+	rs.closed = false
+	rs.mu.Unlock()
+}
+
+// resumeHandshake reads the hello of the client, and issues or
+// resumes its session. It returns false if the connection should be
+// closed.
+func (s *connS) resumeHandshake(ctx context.Context) bool {
+	conn := s.conn.Load()
+	line, rest, err := readResumeLine(conn, s.writeTimeout)
+	var token string
+	var offset uint64
+	if err == nil {
+		token, offset, err = parseResumeLine(line, "RESUME")
+	}
+	if err != nil {
+		s.Debug("[connS] resumption handshake failed", "err", err)
+		return false
+	}
+	if len(rest) > 0 {
+		conn = &sniffedConn{Conn: conn, lead: rest}
+	}
+
+	var replay []byte
+	var unsent []*writeReq
+	var r *resumable
+	if token != "-" {
+		r, replay, unsent = s.resumer.resume(s, token, offset)
+	}
+	if r != nil {
+		s.sess = r.sess
+		s.Debug("[connS] session resumed", "offset", offset, "replay", len(replay), "queued", len(unsent))
+	} else if r, err = s.resumer.issue(s); err != nil {
+		s.Debug("[connS] cannot issue session token", "err", err)
+		return false
+	} else {
+		offset = 0
+	}
+	s.conn.Store(&resumeConn{Conn: conn, r: r})
+	s.rs = r
+
+	reply := fmt.Appendf(nil, "SESSION %s %d\n", r.token, offset)
+	if err = conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err == nil {
+		if _, err = conn.Write(append(reply, replay...)); err == nil {
+			err = writeBatch(ctx, s.protocolInterceptor, s, unsent, s.rawWriteBuffers)
+		}
+	}
+	if err != nil {
+		s.Debug("[connS] resumption handshake failed", "err", err)
+		return false
+	}
+	return true
+}
+
+// closeSession closes the session of the connection, or keeps it for
+// resuming.
+func (s *connS) closeSession() {
+	if s.rs != nil {
+		s.resumer.detach(s)
+		return
+	}
+	s.sess.close()
+}
+
+// resumeConn retains the bytes written for the replay.
+type resumeConn struct {
+	net.Conn
+	r *resumable
+}
+
+func (c *resumeConn) Write(p []byte) (int, error) {
+	c.r.record(p)
+	return c.Conn.Write(p)
+}
+
+// writeBuffers is the vectored write, which net.Buffers cannot do on
+// the wrapped connection.
+func (c *resumeConn) writeBuffers(bufs net.Buffers) (int64, error) {
+	c.r.record(bufs...)
+	return bufs.WriteTo(c.Conn)
+}
+
+// readResumeLine reads a handshake line. The bytes read after it are
+// returned as rest.
+func readResumeLine(conn net.Conn, timeout time.Duration) (line string, rest []byte, err error) {
+	if err = conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	br := bufio.NewReaderSize(conn, resumeLineMax)
+	var b []byte
+	if b, err = br.ReadSlice('\n'); err != nil {
+		return
+	}
+	line = string(b)
+	if n := br.Buffered(); n > 0 {
+		b, _ = br.Peek(n)
+		rest = append([]byte(nil), b...)
+	}
+	return
+}
+
+// parseResumeLine parses "<verb> <token> <offset>".
+func parseResumeLine(line, verb string) (token string, offset uint64, err error) {
+	f := strings.Fields(line)
+	if len(f) != 3 || f[0] != verb {
+		return "", 0, errResumeHandshake
+	}
+	if offset, err = strconv.ParseUint(f[2], 10, 64); err != nil {
+		return "", 0, errResumeHandshake
+	}
+	return f[1], offset, nil
+}
+
+// ResumeState keeps the session token of a client and the count of
+// bytes received, across the reconnections. Pass the same one to each
+// new client:
+//
+//	state := &net.ResumeState{}
+//	c := net.NewClient(net.WithClientResumption(state))
+//	err := c.Dial("tcp", addr)
+//	// ... lost, then
+//	c = net.NewClient(net.WithClientResumption(state))
+//	err = c.Dial("tcp", addr)
+//	resumed := state.Resumed()
+//
+// The zero value is ready to use.
+type ResumeState struct {
+	mu       sync.Mutex
+	token    string
+	received uint64
+	resumed  bool
+}
+
+// WithClientResumption makes Dial resume the session kept by state,
+// or begin a new one, see WithServerResumption.
+//
+// The bytes read after a Hijack are not counted, so the client cannot
+// resume after hijacked.
+func WithClientResumption(state *ResumeState) ClientOpt {
+	return func(s *clientS) {
+		s.rs = state
+	}
+}
+
+// Token returns the session token, or "" before the first handshake.
+func (r *ResumeState) Token() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.token
+}
+
+// Resumed tells whether the last handshake resumed the session.
+func (r *ResumeState) Resumed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.resumed
+}
+
+func (r *ResumeState) add(n int) {
+	r.mu.Lock()
+	r.received += uint64(n)
+	r.mu.Unlock()
+}
+
+// handshake presents the token on conn, and reads the reply byte by
+// byte, leaving the replayed bytes to the reading loop.
+func (r *ResumeState) handshake(conn net.Conn, timeout time.Duration) (err error) {
+	r.mu.Lock()
+	token, received := r.token, r.received
+	r.mu.Unlock()
+	if token == "" {
+		token = "-"
+	}
+
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	if _, err = fmt.Fprintf(conn, "RESUME %s %d\n", token, received); err != nil {
+		return
+	}
+	line := make([]byte, 0, resumeLineMax)
+	for len(line) == 0 || line[len(line)-1] != '\n' {
+		if len(line) == cap(line) {
+			return errResumeHandshake
+		}
+		var n int
+		if n, err = conn.Read(line[len(line) : len(line)+1]); err != nil {
+			return
+		}
+		line = line[:len(line)+n]
+	}
+
+	var offset uint64
+	if token, offset, err = parseResumeLine(string(line), "SESSION"); err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resumed = token == r.token
+	r.token, r.received = token, offset
+	return
+}
@@ -0,0 +1,318 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	stdnet "net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// resumeProcessor keeps a value in the session by "set <v>", replies
+// it to "get", and replies two lines to "burst".
+func resumeProcessor(value *SessionKey[string]) OnTcpServerProcessData {
+	return func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return 0, ErrIncompleteFrame
+		}
+		cmd, arg, _ := strings.Cut(string(data[:i]), " ")
+		switch cmd {
+		case "set":
+			value.Set(SessionOf(w), arg)
+			_, err = w.Write([]byte("ok\n"))
+		case "get":
+			v, _ := value.Get(SessionOf(w))
+			_, err = w.Write([]byte(v + "\n"))
+		case "burst":
+			if _, err = w.Write([]byte("a\n")); err == nil {
+				_, err = w.Write([]byte("b\n"))
+			}
+		}
+		return i + 1, err
+	}
+}
+
+func TestServer_resumption(t *testing.T) {
+	value, hooked := NewSessionKey[string]("value"), NewSessionKey[bool]("hooked")
+	closed := make(chan string, 4)
+	addr, _ := startTestServer(t,
+		WithServerResumption(300*time.Millisecond, 0),
+		WithServerOnClientConnected(func(w api.Response, ss Server) {
+			sess := SessionOf(w)
+			if _, loaded := hooked.LoadOrStore(sess, func() bool { return true }); !loaded { // once per session
+				sess.OnClose(func(sess *Session) {
+					v, _ := value.Get(sess)
+					closed <- v
+				})
+			}
+		}),
+		WithServerOnProcessData(resumeProcessor(value)),
+	)
+
+	dial := func(hello string) (stdnet.Conn, *bufio.Reader, []string) {
+		t.Helper()
+		conn, _ := dialLines(t, addr)
+		br := bufio.NewReader(conn)
+		if _, err := conn.Write([]byte(hello)); err != nil {
+			t.Fatal(err)
+		}
+		return conn, br, strings.Fields(readLine(t, br))
+	}
+	send := func(conn stdnet.Conn, line string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conn, br, reply := dial("RESUME - 0\n")
+	if len(reply) != 3 || reply[0] != "SESSION" || reply[2] != "0" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	token := reply[1]
+	send(conn, "set v")
+	expectLine(t, br, "ok")
+	send(conn, "burst")
+	expectLine(t, br, "a") // 5 bytes received, "b\n" is lost
+	_ = conn.Close()
+
+	conn, br, reply = dial(fmt.Sprintf("RESUME %s 5\n", token))
+	if strings.Join(reply, " ") != "SESSION "+token+" 5" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	expectLine(t, br, "b")
+	send(conn, "get")
+	expectLine(t, br, "v")
+	_ = conn.Close()
+
+	conn, br, reply = dial("RESUME unknown 0\n")
+	if len(reply) != 3 || reply[1] == token || reply[2] != "0" {
+		t.Fatalf("expect a new session, but got %q", reply)
+	}
+	send(conn, "get")
+	expectLine(t, br, "")
+	_ = conn.Close()
+
+	var values []string
+	for len(values) < 2 {
+		select {
+		case v := <-closed:
+			values = append(values, v)
+		case <-time.After(5 * time.Second):
+			t.Fatal("expect the sessions closed after the window")
+		}
+	}
+	if slices.Sort(values); !slices.Equal(values, []string{"", "v"}) {
+		t.Fatalf("unexpected sessions closed: %q", values)
+	}
+}
+
+func TestClient_resumption(t *testing.T) {
+	addr, _ := startTestServer(t,
+		WithServerResumption(time.Minute, 0),
+		WithServerOnProcessData(resumeProcessor(NewSessionKey[string]("value"))),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := &ResumeState{}
+	dial := func() (*clientS, *lineCollector) {
+		t.Helper()
+		lc := &lineCollector{lines: make(chan string, 8)}
+		c := NewClient(WithClientLogger(testLogger()), WithClientInterceptor(lc), WithClientResumption(state))
+		if err := c.Dial("tcp", addr); err != nil {
+			t.Fatal(err)
+		}
+		c.Run(ctx)
+		return c, lc
+	}
+	roundTrip := func(c *clientS, lc *lineCollector, line, expect string) {
+		t.Helper()
+		if _, err := c.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-lc.lines:
+			if got != expect {
+				t.Fatalf("expect %q, but got %q", expect, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", expect)
+		}
+	}
+
+	c, lc := dial()
+	if state.Resumed() || state.Token() == "" {
+		t.Fatalf("expect a new session, but got resumed = %v, token = %q", state.Resumed(), state.Token())
+	}
+	roundTrip(c, lc, "set v\n", "ok\n")
+	c.Close()
+
+	c, lc = dial()
+	defer c.Close()
+	if !state.Resumed() {
+		t.Fatal("expect the session resumed")
+	}
+	roundTrip(c, lc, "get\n", "v\n")
+}
+
+func TestServer_resumeAuthenticated(t *testing.T) {
+	addr, _ := startTestServer(t,
+		WithServerResumption(time.Minute, 0),
+		WithServerAuthenticator(TokenAuth(func(token string) (string, error) {
+			if name, ok := map[string]string{"t1": "alice", "t2": "bob"}[token]; ok {
+				return name, nil
+			}
+			return "", ErrAuthFailed
+		})),
+		WithServerOnProcessData(whoamiProcessor),
+	)
+	dial := func(hello string) []string {
+		t.Helper()
+		conn, _ := dialLines(t, addr)
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		if _, err := conn.Write([]byte(hello)); err != nil { // the hello is read ahead by the authenticator
+			t.Fatal(err)
+		}
+		expectLine(t, br, "+OK")
+		return strings.Fields(readLine(t, br))
+	}
+
+	reply := dial("t1\nRESUME - 0\n")
+	if len(reply) != 3 || reply[0] != "SESSION" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	token := reply[1]
+	if reply = dial("t2\nRESUME " + token + " 0\n"); len(reply) != 3 || reply[1] == token {
+		t.Fatalf("expect the session refused to another principal, but got %q", reply)
+	}
+	if reply = dial("t1\nRESUME " + token + " 0\n"); strings.Join(reply, " ") != "SESSION "+token+" 0" {
+		t.Fatalf("expect the session resumed, but got %q", reply)
+	}
+
+	// the client authenticates before the resumption handshake
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lc := &lineCollector{lines: make(chan string, 8)}
+	c := NewClient(WithClientLogger(testLogger()), WithClientInterceptor(lc),
+		WithClientResumption(&ResumeState{}),
+		WithClientAuth(func(conn stdnet.Conn) (err error) {
+			if _, err = conn.Write([]byte("t2\n")); err == nil {
+				var line string
+				if line, err = bufio.NewReader(conn).ReadString('\n'); err == nil && line != "+OK\n" {
+					err = ErrAuthFailed
+				}
+			}
+			return
+		}))
+	if err := c.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Run(ctx)
+	if _, err := c.Write([]byte("who\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-lc.lines:
+		if got != "bob token\n" {
+			t.Fatalf("expect %q, but got %q", "bob token\n", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+// holdWriter holds the writing of "hold\n" till released, so that the
+// messages behind it stay queued.
+type holdWriter struct {
+	held, release chan struct{}
+}
+
+func (h *holdWriter) OnListened(baseCtx context.Context, addr string) {}
+func (h *holdWriter) OnServerReady(ctx context.Context)               {}
+func (h *holdWriter) OnServerClosed()                                 {}
+
+func (h *holdWriter) OnReading(ctx context.Context, conn api.Conn, data []byte, ch chan<- []byte) (processed bool, err error) {
+	return
+}
+
+func (h *holdWriter) OnWriting(ctx context.Context, conn api.Conn, data []byte) (processed bool, err error) {
+	if string(data) == "hold\n" {
+		close(h.held)
+		<-h.release
+	}
+	return
+}
+
+func TestServer_resumeUnsent(t *testing.T) {
+	hw := &holdWriter{held: make(chan struct{}), release: make(chan struct{})}
+	addr, _ := startTestServer(t,
+		WithServerResumption(time.Minute, 0),
+		func(s *serverWrap) { s.protocolInterceptor = hw },
+		WithServerOnProcessData(func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+			nn = len(data)
+			if string(data) != "queue\n" {
+				return
+			}
+			if _, err = w.Write([]byte("hold\n")); err != nil {
+				return
+			}
+			<-hw.held
+			for _, line := range []string{"c\n", "d\n"} {
+				if _, err = w.Write([]byte(line)); err != nil {
+					return
+				}
+			}
+			w.Close() // lost while c and d are queued behind the writing
+			close(hw.release)
+			return
+		}),
+	)
+
+	conn, _ := dialLines(t, addr)
+	br := bufio.NewReader(conn)
+	if _, err := conn.Write([]byte("RESUME - 0\nqueue\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply := strings.Fields(readLine(t, br))
+	if len(reply) != 3 || reply[0] != "SESSION" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if line, err := br.ReadString('\n'); err == nil {
+		t.Fatalf("expect the connection lost, but got %q", line)
+	}
+
+	conn, _ = dialLines(t, addr)
+	br = bufio.NewReader(conn)
+	if _, err := conn.Write([]byte("RESUME " + reply[1] + " 0\n")); err != nil {
+		t.Fatal(err)
+	}
+	expectLine(t, br, "SESSION "+reply[1]+" 0")
+	expectLine(t, br, "c")
+	expectLine(t, br, "d")
+}
+
+func readLine(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func expectLine(t *testing.T, br *bufio.Reader, expect string) {
+	t.Helper()
+	if line := readLine(t, br); line != expect {
+		t.Fatalf("expect %q, but got %q", expect, line)
+	}
+}
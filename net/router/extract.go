@@ -0,0 +1,71 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+
+	"github.com/hedzr/go-socketlib/net"
+)
+
+// FirstWord extracts the first word of a text line, in lower case, as
+// the key. The payload is the rest of the line, without the leading
+// spaces and the line ending.
+func FirstWord() Extractor[string] {
+	return func(data []byte) (key string, payload []byte, n int, err error) {
+		var line []byte
+		if line, n, err = splitLine(data); err != nil {
+			return
+		}
+		word, rest, _ := bytes.Cut(bytes.TrimLeft(line, " \t"), []byte(" "))
+		return string(bytes.ToLower(word)), bytes.TrimLeft(rest, " \t"), n, nil
+	}
+}
+
+// Opcode extracts the opcode of a binary header: a 2-byte opcode and
+// a 4-byte length of the payload following it, in the byte order.
+func Opcode(order binary.ByteOrder) Extractor[uint16] {
+	const headerLen = 6
+	return func(data []byte) (key uint16, payload []byte, n int, err error) {
+		if len(data) < headerLen {
+			return 0, nil, 0, net.ErrIncompleteFrame
+		}
+		key, size := order.Uint16(data), order.Uint32(data[2:])
+		if uint64(len(data)-headerLen) < uint64(size) {
+			return 0, nil, 0, net.ErrIncompleteFrame
+		}
+		n = headerLen + int(size)
+		return key, data[headerLen:n], n, nil
+	}
+}
+
+// JSONField extracts the string field of a JSON object as the key.
+// The objects are delimited by line endings, and the payload is the
+// whole object.
+func JSONField(field string) Extractor[string] {
+	return func(data []byte) (key string, payload []byte, n int, err error) {
+		var line []byte
+		if line, n, err = splitLine(data); err != nil {
+			return
+		}
+		var obj map[string]json.RawMessage
+		if err = json.Unmarshal(line, &obj); err != nil {
+			return
+		}
+		if raw, ok := obj[field]; ok {
+			if err = json.Unmarshal(raw, &key); err != nil {
+				return
+			}
+		}
+		return key, line, n, nil
+	}
+}
+
+// splitLine returns the first line without the line ending.
+func splitLine(data []byte) (line []byte, n int, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, 0, net.ErrIncompleteFrame
+	}
+	return bytes.TrimSuffix(data[:i], []byte("\r")), i + 1, nil
+}
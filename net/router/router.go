@@ -0,0 +1,176 @@
+// Package router dispatches the incoming messages to the handlers by
+// a key, such as the command of a text line, the opcode of a binary
+// header, or the type field of a JSON object.
+//
+// A Router is a net.Handler and a net.DataProcessor:
+//
+//	r := router.New(router.FirstWord())
+//	r.Handle("user", handleUser)
+//	r.Handle("retr", handleRetr, router.WithTimeout[string](5*time.Second))
+//	r.NotFound(func(ctx context.Context, m *router.Message[string]) error {
+//		_, err := m.W.Write([]byte("-ERR unknown command\r\n"))
+//		return err
+//	})
+//	server := net.NewServer(addr, net.WithServerHandler(r))
+package router
+
+import (
+	"context"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net"
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// Message is a frame routed to a handler.
+//
+// Frame and Payload refer to the reading buffer, do not retain them
+// after the handler returned.
+type Message[K comparable] struct {
+	Key     K
+	Frame   []byte // the whole frame
+	Payload []byte // the frame without the key, see Extractor
+	W       api.Response
+	R       api.Request
+}
+
+// HandlerFunc handles a routed message. Returning an error closes
+// the connection.
+type HandlerFunc[K comparable] func(ctx context.Context, m *Message[K]) error
+
+// Middleware wraps a HandlerFunc.
+type Middleware[K comparable] func(next HandlerFunc[K]) HandlerFunc[K]
+
+// Extractor splits the first frame from data, and extracts its key.
+// It returns the length of the frame, or net.ErrIncompleteFrame if
+// data holds a partial frame only.
+type Extractor[K comparable] func(data []byte) (key K, payload []byte, n int, err error)
+
+// Router dispatches the frames by the keys.
+type Router[K comparable] struct {
+	extract  Extractor[K]
+	routes   map[K]HandlerFunc[K]
+	notFound HandlerFunc[K]
+	mws      []Middleware[K]
+}
+
+func New[K comparable](extract Extractor[K]) *Router[K] {
+	return &Router[K]{
+		extract: extract,
+		routes:  make(map[K]HandlerFunc[K]),
+	}
+}
+
+// Use adds the middlewares applied to all routes registered after it,
+// and the NotFound handler. The first one is the outermost.
+func (r *Router[K]) Use(mws ...Middleware[K]) {
+	r.mws = append(r.mws, mws...)
+}
+
+// RouteOpt configures a route.
+type RouteOpt[K comparable] func(rt *route[K])
+
+type route[K comparable] struct {
+	timeout time.Duration
+	mws     []Middleware[K]
+}
+
+// WithTimeout limits the handling of a message of the route. The ctx
+// passed to the handler is cancelled after d, the handler should give
+// up then.
+//
+// The timeout is cooperative: the handler is not interrupted, and the
+// reading of the connection waits till it returned.
+func WithTimeout[K comparable](d time.Duration) RouteOpt[K] {
+	return func(rt *route[K]) {
+		rt.timeout = d
+	}
+}
+
+// WithMiddlewares wraps the handler of the route by mws, inside the
+// router-wide ones.
+func WithMiddlewares[K comparable](mws ...Middleware[K]) RouteOpt[K] {
+	return func(rt *route[K]) {
+		rt.mws = append(rt.mws, mws...)
+	}
+}
+
+// Handle registers h for the messages of key. The routes should be
+// registered before the server starts.
+func (r *Router[K]) Handle(key K, h HandlerFunc[K], opts ...RouteOpt[K]) {
+	r.routes[key] = r.wrap(h, opts)
+}
+
+// NotFound sets the handler of the messages of unknown keys. By
+// default, they are logged and skipped.
+func (r *Router[K]) NotFound(h HandlerFunc[K], opts ...RouteOpt[K]) {
+	r.notFound = r.wrap(h, opts)
+}
+
+func (r *Router[K]) wrap(h HandlerFunc[K], opts []RouteOpt[K]) HandlerFunc[K] {
+	var rt route[K]
+	for _, opt := range opts {
+		opt(&rt)
+	}
+	for i := len(rt.mws) - 1; i >= 0; i-- {
+		h = rt.mws[i](h)
+	}
+	if d := rt.timeout; d > 0 {
+		h = withTimeout(d, h)
+	}
+	for i := len(r.mws) - 1; i >= 0; i-- {
+		h = r.mws[i](h)
+	}
+	return h
+}
+
+func withTimeout[K comparable](d time.Duration, next HandlerFunc[K]) HandlerFunc[K] {
+	return func(ctx context.Context, m *Message[K]) error {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return next(ctx, m)
+	}
+}
+
+// Serve lets the default reading loop serve the connection, with
+// Process as the data processor.
+func (r *Router[K]) Serve(ctx context.Context, w api.Response, req api.Request) (processed bool, err error) {
+	return
+}
+
+// Process dispatches the complete frames in data.
+//
+// A bad frame following the dispatched ones is left to the next call,
+// which reports it through the corrupt data handler of the server.
+func (r *Router[K]) Process(data []byte, w api.Response, req api.Request) (nn int, err error) {
+	ctx := net.ContextOf(w)
+	for nn < len(data) {
+		key, payload, n, e := r.extract(data[nn:])
+		if e != nil || n <= 0 {
+			if nn > 0 {
+				return nn, nil // the dispatched ones go first
+			} else if e == nil {
+				e = net.ErrIncompleteFrame
+			}
+			return nn, e
+		}
+
+		m := &Message[K]{Key: key, Frame: data[nn : nn+n], Payload: payload, W: w, R: req}
+		nn += n
+		if err = r.dispatch(ctx, m); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *Router[K]) dispatch(ctx context.Context, m *Message[K]) error {
+	if h, ok := r.routes[m.Key]; ok {
+		return h(ctx, m)
+	}
+	if r.notFound != nil {
+		return r.notFound(ctx, m)
+	}
+	net.LoggerFromContext(ctx).Warn("[router] unknown command skipped", "key", m.Key, "client.addr", m.W.RemoteAddrString())
+	return nil
+}
@@ -0,0 +1,175 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net"
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func TestExtractors(t *testing.T) {
+	key, payload, n, err := FirstWord()([]byte("  RETR 1\r\nnext"))
+	if err != nil || key != "retr" || string(payload) != "1" || n != 10 {
+		t.Fatalf("FirstWord: got %q, %q, %d, %v", key, payload, n, err)
+	}
+	if _, _, _, err = FirstWord()([]byte("RETR")); err != net.ErrIncompleteFrame {
+		t.Fatalf("FirstWord: expect incomplete, but got %v", err)
+	}
+
+	frame := binary.BigEndian.AppendUint16(nil, 7)
+	frame = binary.BigEndian.AppendUint32(frame, 3)
+	op, payload, n, err := Opcode(binary.BigEndian)(append(frame, "abcd"...))
+	if err != nil || op != 7 || string(payload) != "abc" || n != 9 {
+		t.Fatalf("Opcode: got %d, %q, %d, %v", op, payload, n, err)
+	}
+	if _, _, _, err = Opcode(binary.BigEndian)(append(frame, "ab"...)); err != net.ErrIncompleteFrame {
+		t.Fatalf("Opcode: expect incomplete, but got %v", err)
+	}
+
+	key, _, n, err = JSONField("type")([]byte(`{"type":"ping","id":1}` + "\n"))
+	if err != nil || key != "ping" || n != 23 {
+		t.Fatalf("JSONField: got %q, %d, %v", key, n, err)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	reply := func(s string) HandlerFunc[string] {
+		return func(ctx context.Context, m *Message[string]) (err error) {
+			_, err = m.W.Write([]byte(s + " " + string(m.Payload) + "\n"))
+			return
+		}
+	}
+	upper := func(next HandlerFunc[string]) HandlerFunc[string] {
+		return func(ctx context.Context, m *Message[string]) error {
+			m.Payload = []byte("[" + string(m.Payload) + "]")
+			return next(ctx, m)
+		}
+	}
+
+	r := New(FirstWord())
+	r.Handle("echo", reply("echo"))
+	r.Handle("wrap", reply("wrap"), WithMiddlewares(upper))
+	r.Handle("slow", func(ctx context.Context, m *Message[string]) (err error) {
+		<-ctx.Done()
+		_, err = m.W.Write([]byte("slow " + ctx.Err().Error() + "\n"))
+		return
+	}, WithTimeout[string](10*time.Millisecond))
+	r.NotFound(reply("unknown"))
+
+	addr := startServer(t, net.WithServerHandler(r))
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err = conn.Write([]byte("ECHO hi\r\nwrap x\nfoo bar\nsl")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err = conn.Write([]byte("ow\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for _, expect := range []string{"echo hi", "wrap [x]", "unknown bar", "slow context deadline exceeded"} {
+		if !scanner.Scan() {
+			t.Fatal(scanner.Err())
+		}
+		if scanner.Text() != expect {
+			t.Fatalf("expect %q, but got %q", expect, scanner.Text())
+		}
+	}
+}
+
+func startServer(t *testing.T, opts ...net.ServerOpt) (addr string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := net.NewServer("127.0.0.1:0", append([]net.ServerOpt{
+		net.WithServerQuiet(true),
+		net.WithServerLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		net.WithServerOnListening(func(ss net.Server, l stdnet.Listener) { addr = l.Addr().String() }),
+	}, opts...)...)
+	if err := s.Start(ctx); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		_ = s.Stop()
+	})
+	return
+}
+
+func TestRouter_badFrameAfterDispatched(t *testing.T) {
+	errBad := errors.New("bad frame")
+	firstWord := FirstWord()
+	r := New(func(data []byte) (key string, payload []byte, n int, err error) {
+		if len(data) > 0 && data[0] == '!' {
+			return "", nil, 0, errBad
+		}
+		return firstWord(data)
+	})
+	r.Handle("echo", func(ctx context.Context, m *Message[string]) (err error) {
+		_, err = m.W.Write([]byte(string(m.Payload) + "\n"))
+		return
+	})
+
+	corrupt := make(chan string, 1)
+	addr := startServer(t, net.WithServerHandler(r),
+		net.WithServerOnCorruptData(func(data []byte, w api.Response, req api.Request) (ate int) {
+			ate = bytes.IndexByte(data, '\n') + 1
+			corrupt <- string(data[:ate])
+			return
+		}))
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	scanner := bufio.NewScanner(conn)
+	expect := func(lines ...string) {
+		t.Helper()
+		for _, line := range lines {
+			if !scanner.Scan() {
+				t.Fatal(scanner.Err())
+			}
+			if scanner.Text() != line {
+				t.Fatalf("expect %q, but got %q", line, scanner.Text())
+			}
+		}
+	}
+
+	// the connection is kept, the bad frame is reported by the next read
+	if _, err = conn.Write([]byte("echo hi\n!bad\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("hi")
+	if _, err = conn.Write([]byte("echo again\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-corrupt:
+		if got != "!bad\n" {
+			t.Fatalf("expect the bad frame reported, but got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the bad frame reported")
+	}
+	if _, err = conn.Write([]byte("echo more\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("again", "more")
+}
@@ -0,0 +1,187 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	stdnet "net"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// startTestServer starts a tcp server at a random port of loopback
+// interface and returns its listening address.
+func startTestServer(t *testing.T, opts ...ServerOpt) (addr string, s *serverWrap) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	s = NewServer("127.0.0.1:0", append([]ServerOpt{
+		WithServerQuiet(true),
+		WithServerLogger(testLogger()),
+		WithServerOnListening(func(ss Server, l stdnet.Listener) {
+			if l != nil {
+				addr = l.Addr().String()
+			}
+		}),
+	}, opts...)...)
+	if err := s.Start(ctx); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		_ = s.Stop()
+	})
+	return
+}
+
+// testLogger discards the logs unless 'go test -v'.
+func testLogger() Logger {
+	if testing.Verbose() {
+		return newDefaultLogger()
+	}
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func echoProcessor(data []byte, w api.Response, r api.Request) (nn int, err error) {
+	nn = len(data)
+	_, err = w.Write(append([]byte(nil), data...))
+	return
+}
+
+func TestServer_echoCoalesced(t *testing.T) {
+	addr, _ := startTestServer(t,
+		WithServerWriteBatch(4, time.Millisecond),
+		WithServerOnProcessData(echoProcessor),
+	)
+	testEcho(t, addr, 100)
+}
+
+func TestServer_releaseIdleBuffer(t *testing.T) {
+	addr, _ := startTestServer(t,
+		WithServerReleaseIdleBuffer(true),
+		WithServerOnProcessData(echoProcessor),
+	)
+	testEcho(t, addr, 10)
+}
+
+// testEcho sends some lines to an echo server and checks the replies.
+func testEcho(t *testing.T, addr string, lines int) {
+	t.Helper()
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		for i := 0; i < lines; i++ {
+			_, _ = conn.Write([]byte("hello, world\n"))
+			if i%3 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	for i := 0; i < lines; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("line %d: %v", i, scanner.Err())
+		}
+		if line := scanner.Text(); line != "hello, world" {
+			t.Fatalf("line %d: expect echo, but got %q", i, line)
+		}
+	}
+}
+
+func TestServer_wrChannel(t *testing.T) {
+	conns := make(chan *connS, 1)
+	addr, _ := startTestServer(t,
+		WithServerWriteQueueSize(4),
+		WithServerOnClientConnected(func(w api.Response, ss Server) { conns <- w.(*connS) }),
+	)
+	conn, scanner := dialLines(t, addr)
+	c := <-conns
+	for i := 0; i < 4; i++ { // buffered, not blocked by the writing loop
+		c.WrChannel() <- []byte("hi\n")
+	}
+	expectLines(t, scanner, "hi", "hi", "hi", "hi")
+
+	_ = conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); c.NotClosed(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("expect the connection closed")
+		}
+	}
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 16; i++ {
+			select {
+			case c.WrChannel() <- []byte("lost\n"):
+			case <-c.Done():
+			}
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the senders are blocked after closed")
+	}
+}
+
+func TestClient_writeAsync(t *testing.T) {
+	addr, _ := startTestServer(t, WithServerOnProcessData(echoProcessor))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewClient(WithClientLogger(testLogger()))
+	if err := c.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	c.Run(ctx)
+
+	wc := c.WriteAsync(ctx, []byte("hello"))
+	if n, err := wc.Wait(ctx); n != 5 || err != nil {
+		t.Fatalf("expect 5 bytes sent, but got %d, %v", n, err)
+	}
+
+	// RawWrite gives up immediately on a cancelled context
+	cancelled, cancel2 := context.WithCancel(ctx)
+	cancel2()
+	if _, err := c.RawWrite(cancelled, []byte("world")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expect context.Canceled, but got %v", err)
+	}
+
+	c.Close()
+	wc = c.WriteAsync(ctx, []byte("after closed"))
+	if _, err := wc.Wait(ctx); err == nil {
+		t.Fatal("expect writing to a closed client failed")
+	}
+}
+
+func TestClient_writeWhileRun(t *testing.T) {
+	addr, _ := startTestServer(t, WithServerOnProcessData(echoProcessor))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewClient(WithClientLogger(testLogger()))
+	if err := c.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	written := make(chan error, 1)
+	go func() { // reads the context of Run concurrently
+		_, err := c.Write([]byte("hello"))
+		written <- err
+	}()
+	c.Run(ctx)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
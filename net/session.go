@@ -0,0 +1,156 @@
+package net
+
+import (
+	"sync"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// Session is a concurrency-safe attribute store attached to each
+// server connection, see SessionOf. It lives as long as the
+// connection, and the OnClose hooks are invoked after the connection
+// closed or hijacked. With WithServerResumption, it lives till the
+// resumption window expired instead.
+type Session struct {
+	mu      sync.RWMutex
+	attrs   map[any]any
+	onClose []func(sess *Session)
+	closed  bool
+}
+
+func newSession() *Session {
+	return &Session{attrs: make(map[any]any)}
+}
+
+// SessionOf returns the session of a server connection, or nil for
+// other responses, such as the udp packets.
+func SessionOf(w api.Response) *Session {
+	if c, ok := w.(*connS); ok {
+		return c.Session()
+	}
+	return nil
+}
+
+// Session returns the session of the connection.
+func (s *connS) Session() *Session { return s.sess }
+
+// Get returns the value of key.
+func (s *Session) Get(key any) (v any, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok = s.attrs[key]
+	return
+}
+
+// Set sets the value of key. Like context keys, key should be of an
+// unexported type to avoid collisions, or use SessionKey.
+func (s *Session) Set(key, v any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = v
+}
+
+// Delete removes key.
+func (s *Session) Delete(key any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attrs, key)
+}
+
+// LoadOrStore returns the value of key if present. Otherwise, it sets
+// and returns the value made by fn. fn is called with the session
+// locked, it must not access the session.
+func (s *Session) LoadOrStore(key any, fn func() any) (v any, loaded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, loaded = s.attrs[key]; !loaded {
+		v = fn()
+		s.attrs[key] = v
+	}
+	return
+}
+
+// Range calls fn for each attribute till fn returns false.
+func (s *Session) Range(fn func(key, v any) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k, v := range s.attrs {
+		if !fn(k, v) {
+			return
+		}
+	}
+}
+
+// OnClose adds a hook invoked after the connection closed. It is
+// invoked at once if the session has been closed.
+func (s *Session) OnClose(fn func(sess *Session)) {
+	s.mu.Lock()
+	if !s.closed {
+		s.onClose = append(s.onClose, fn)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	fn(s)
+}
+
+// Closed tells whether the connection of the session has been closed.
+func (s *Session) Closed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+// close invokes the OnClose hooks in the reverse order of adding. The
+// attributes are kept for the hooks.
+func (s *Session) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	hooks := s.onClose
+	s.onClose = nil
+	s.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i](s)
+	}
+}
+
+// SessionKey is a typed key of Session attributes.
+type SessionKey[T any] struct {
+	name string
+}
+
+// NewSessionKey makes a key. The name is for debugging only, keys are
+// distinct even with the same name.
+func NewSessionKey[T any](name string) *SessionKey[T] {
+	return &SessionKey[T]{name: name}
+}
+
+func (k *SessionKey[T]) String() string { return k.name }
+
+// Get returns the value of k in sess.
+func (k *SessionKey[T]) Get(sess *Session) (v T, ok bool) {
+	var a any
+	if a, ok = sess.Get(k); ok {
+		v, ok = a.(T)
+	}
+	return
+}
+
+// Set sets the value of k in sess.
+func (k *SessionKey[T]) Set(sess *Session, v T) { sess.Set(k, v) }
+
+// Delete removes k from sess.
+func (k *SessionKey[T]) Delete(sess *Session) { sess.Delete(k) }
+
+// LoadOrStore returns the value of k, or sets it by fn, see
+// Session.LoadOrStore.
+func (k *SessionKey[T]) LoadOrStore(sess *Session, fn func() T) (v T, loaded bool) {
+	var a any
+	a, loaded = sess.LoadOrStore(k, func() any { return fn() })
+	v, _ = a.(T)
+	return
+}
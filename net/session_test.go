@@ -0,0 +1,64 @@
+package net
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func TestSessionKey(t *testing.T) {
+	sess := newSession()
+	user, count := NewSessionKey[string]("user"), NewSessionKey[int]("count")
+	if _, ok := user.Get(sess); ok {
+		t.Fatal("expect no user")
+	}
+	user.Set(sess, "bob")
+	if v, loaded := count.LoadOrStore(sess, func() int { return 3 }); loaded || v != 3 {
+		t.Fatalf("expect stored 3, but got %v, %v", v, loaded)
+	}
+	if v, ok := user.Get(sess); !ok || v != "bob" {
+		t.Fatalf("expect bob, but got %q", v)
+	}
+	user.Delete(sess)
+	if _, ok := user.Get(sess); ok {
+		t.Fatal("expect user deleted")
+	}
+}
+
+func TestServer_session(t *testing.T) {
+	hits := NewSessionKey[int]("hits")
+	closed := make(chan int, 1)
+	addr, _ := startTestServer(t,
+		WithServerOnClientConnected(func(w api.Response, ss Server) {
+			SessionOf(w).OnClose(func(sess *Session) {
+				n, _ := hits.Get(sess)
+				closed <- n
+			})
+		}),
+		WithServerOnProcessData(func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+			sess := SessionOf(w)
+			n, _ := hits.Get(sess)
+			hits.Set(sess, n+1)
+			return echoProcessor(data, w, r)
+		}),
+	)
+
+	conn, scanner := dialLines(t, addr)
+	for _, line := range []string{"a", "b"} {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		expectLines(t, scanner, line)
+	}
+	_ = conn.Close()
+
+	select {
+	case n := <-closed:
+		if n != 2 {
+			t.Fatalf("expect 2 hits, but got %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the session closed with the connection")
+	}
+}
@@ -0,0 +1,244 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SocketOption is a typed socket option, see WithServerSocketOptions
+// and WithClientSocketOptions.
+//
+// Most of the options are set by ListenConfig.Control or Dialer.Control
+// before the socket is bound or connected; the accepted connections
+// inherit them from the listening socket.
+type SocketOption struct {
+	keepAlive *net.KeepAliveConfig                                   // by ListenConfig and Dialer
+	control   func(network string, fd uintptr, listening bool) error // before bind or connect
+	conn      func(tc *net.TCPConn) error                            // on each accepted or dialed connection
+}
+
+type socketOptions []SocketOption
+
+// WithServerSocketOptions applies the socket options to the listening
+// socket and the accepted connections.
+func WithServerSocketOptions(opts ...SocketOption) ServerOpt {
+	return func(s *serverWrap) {
+		s.sockOpts = append(s.sockOpts, opts...)
+	}
+}
+
+// WithClientSocketOptions applies the socket options to the dialed
+// connection.
+func WithClientSocketOptions(opts ...SocketOption) ClientOpt {
+	return func(c *clientS) {
+		c.sockOpts = append(c.sockOpts, opts...)
+	}
+}
+
+// WithClientDialer gives a user-defined dialer. Its Timeout overrides
+// the default dialing timeout if not zero.
+func WithClientDialer(d *net.Dialer) ClientOpt {
+	return func(c *clientS) {
+		c.dialer = d
+	}
+}
+
+// SocketKeepAlive enables TCP keepalive with the idle time before the
+// first probe, the interval between the probes and the count of the
+// unanswered probes before dropping the connection. For each of them,
+// zero uses the default of Go, and a negative value keeps the one of
+// the system. See SocketNoKeepAlive to disable keepalive.
+func SocketKeepAlive(idle, interval time.Duration, count int) SocketOption {
+	return SocketOption{keepAlive: &net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     idle,
+		Interval: interval,
+		Count:    count,
+	}}
+}
+
+// SocketNoKeepAlive disables TCP keepalive, which Go enables by
+// default.
+func SocketNoKeepAlive() SocketOption {
+	return SocketOption{keepAlive: &net.KeepAliveConfig{Enable: false}}
+}
+
+// SocketNoDelay sets TCP_NODELAY. Go enables it by default, false
+// lets the system coalesce the small writes (Nagle's algorithm).
+func SocketNoDelay(noDelay bool) SocketOption {
+	return SocketOption{conn: func(tc *net.TCPConn) error { return tc.SetNoDelay(noDelay) }}
+}
+
+// SocketLinger sets SO_LINGER of TCP, see net.TCPConn.SetLinger.
+func SocketLinger(sec int) SocketOption {
+	return SocketOption{conn: func(tc *net.TCPConn) error { return tc.SetLinger(sec) }}
+}
+
+// SocketSendBuffer sets SO_SNDBUF.
+func SocketSendBuffer(bytes int) SocketOption {
+	return SocketOption{control: func(network string, fd uintptr, listening bool) error {
+		return setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, bytes)
+	}}
+}
+
+// SocketRecvBuffer sets SO_RCVBUF. It is set before listening or
+// connecting, so that the TCP window scaling follows it.
+func SocketRecvBuffer(bytes int) SocketOption {
+	return SocketOption{control: func(network string, fd uintptr, listening bool) error {
+		return setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, bytes)
+	}}
+}
+
+// SocketUserTimeout sets TCP_USER_TIMEOUT, how long the transmitted
+// data may remain unacknowledged before the connection is dropped.
+// It is supported on Linux only, and ignored on the others.
+func SocketUserTimeout(d time.Duration) SocketOption {
+	return SocketOption{control: func(network string, fd uintptr, listening bool) error {
+		if tcpUserTimeout == 0 || !isTCP(network) {
+			return nil
+		}
+		return setsockoptInt(fd, syscall.IPPROTO_TCP, tcpUserTimeout, int(d/time.Millisecond))
+	}}
+}
+
+// SocketFastOpen enables TCP Fast Open. For a server, queue is the
+// length of the pending TFO requests queue; for a client, the data of
+// the first write is carried by the SYN. It is supported on Linux
+// only, and ignored on the others.
+func SocketFastOpen(queue int) SocketOption {
+	return SocketOption{control: func(network string, fd uintptr, listening bool) error {
+		if tcpFastOpen == 0 || !isTCP(network) {
+			return nil
+		}
+		if listening {
+			return setsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpen, queue)
+		}
+		return setsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	}}
+}
+
+// SocketTOS sets IP_TOS, or IPV6_TCLASS for IPv6. The DSCP value is
+// in the upper six bits, such as 46<<2 for Expedited Forwarding.
+func SocketTOS(tos int) SocketOption {
+	return SocketOption{control: func(network string, fd uintptr, listening bool) error {
+		switch {
+		case strings.HasSuffix(network, "6"):
+			return setsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6TClass, tos)
+		case strings.HasSuffix(network, "4"):
+			return setsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}
+		return nil
+	}}
+}
+
+// SocketV6Only sets IPV6_V6ONLY of an IPv6 socket. By default, Go
+// listens on both IPv4 and IPv6 for a wildcard address of "tcp" or
+// "udp".
+func SocketV6Only(v6only bool) SocketOption {
+	return SocketOption{control: func(network string, fd uintptr, listening bool) error {
+		if !strings.HasSuffix(network, "6") {
+			return nil
+		}
+		return setsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, boolInt(v6only))
+	}}
+}
+
+// listenConfig returns a copy of the user-defined ListenConfig, with
+// the socket options applied.
+func (s *serverWrap) listenConfig() *net.ListenConfig {
+	var lc net.ListenConfig
+	if s.lc != nil {
+		lc = *s.lc
+	}
+	s.sockOpts.keepAlive(&lc.KeepAlive, &lc.KeepAliveConfig)
+	lc.Control = s.sockOpts.controlFunc(true, lc.Control)
+	return &lc
+}
+
+// newDialer returns a copy of the user-defined Dialer, with the
+// socket options applied.
+func (c *clientS) newDialer() *net.Dialer {
+	var d net.Dialer
+	if c.dialer != nil {
+		d = *c.dialer
+	}
+	if d.Timeout == 0 {
+		d.Timeout = c.dialTimeout
+	}
+	c.sockOpts.keepAlive(&d.KeepAlive, &d.KeepAliveConfig)
+	if d.ControlContext != nil { // it takes precedence over Control
+		cc, control := d.ControlContext, c.sockOpts.controlFunc(false, nil)
+		d.ControlContext = func(ctx context.Context, network, address string, rc syscall.RawConn) error {
+			if err := cc(ctx, network, address, rc); err != nil {
+				return err
+			}
+			return control(network, address, rc)
+		}
+	} else {
+		d.Control = c.sockOpts.controlFunc(false, d.Control)
+	}
+	return &d
+}
+
+func (so socketOptions) keepAlive(ka *time.Duration, kac *net.KeepAliveConfig) {
+	for _, o := range so {
+		if o.keepAlive != nil {
+			if *kac = *o.keepAlive; !kac.Enable {
+				*ka = -1
+			}
+		}
+	}
+}
+
+// controlFunc chains the setting of the socket options after next.
+func (so socketOptions) controlFunc(listening bool, next func(network, address string, rc syscall.RawConn) error) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) (err error) {
+		if next != nil {
+			if err = next(network, address, rc); err != nil {
+				return
+			}
+		}
+		cerr := rc.Control(func(fd uintptr) {
+			for _, o := range so {
+				if o.control != nil && err == nil {
+					err = o.control(network, fd, listening)
+				}
+			}
+		})
+		if err == nil {
+			err = cerr
+		}
+		return
+	}
+}
+
+// applyConn applies the per-connection options, which Go resets on
+// each accepted or dialed connection.
+func (so socketOptions) applyConn(conn net.Conn) (err error) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	for _, o := range so {
+		if o.conn != nil && err == nil {
+			err = o.conn(tc)
+		}
+	}
+	return
+}
+
+func isTCP(network string) bool { return strings.HasPrefix(network, "tcp") }
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
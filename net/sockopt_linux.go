@@ -0,0 +1,7 @@
+package net
+
+const (
+	tcpUserTimeout     = 0x12 // TCP_USER_TIMEOUT
+	tcpFastOpen        = 0x17 // TCP_FASTOPEN
+	tcpFastOpenConnect = 0x1e // TCP_FASTOPEN_CONNECT
+)
@@ -0,0 +1,172 @@
+//go:build !386
+
+// linux/386 has no SYS_GETSOCKOPT, the socket calls go through
+// socketcall there, so getsockoptLinger cannot be built.
+
+package net
+
+import (
+	"context"
+	stdnet "net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// rawControl runs fn on the descriptor of conn, a connection or a
+// listener.
+func rawControl(t *testing.T, conn any, fn func(fd int) error) {
+	t.Helper()
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cerr := rc.Control(func(fd uintptr) { err = fn(int(fd)) }); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getsockopt(t *testing.T, conn any, level, name int) (v int) {
+	t.Helper()
+	rawControl(t, conn, func(fd int) (err error) {
+		v, err = syscall.GetsockoptInt(fd, level, name)
+		return
+	})
+	return
+}
+
+// getsockoptLinger gets SO_LINGER, which the syscall package cannot,
+// by the raw getsockopt system call.
+func getsockoptLinger(fd int) (l *syscall.Linger, err error) {
+	l = new(syscall.Linger)
+	n := uint32(unsafe.Sizeof(*l))
+	if _, _, e := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET, syscall.SO_LINGER,
+		uintptr(unsafe.Pointer(l)), uintptr(unsafe.Pointer(&n)), 0); e != 0 {
+		err = e
+	}
+	return
+}
+
+// sockoptCheck expects the value of a socket option, or at least min
+// if expect is negative.
+type sockoptCheck struct {
+	name        string
+	level, opt  int
+	expect, min int
+}
+
+func checkSockopts(t *testing.T, conn any, checks ...sockoptCheck) {
+	t.Helper()
+	for _, c := range checks {
+		v := getsockopt(t, conn, c.level, c.opt)
+		if (c.expect >= 0 && v != c.expect) || v < c.min {
+			t.Errorf("%s: expect %d (min %d), but got %d", c.name, c.expect, c.min, v)
+		}
+	}
+}
+
+func TestSocketOptions(t *testing.T) {
+	opts := []SocketOption{
+		SocketKeepAlive(42*time.Second, 7*time.Second, 3),
+		SocketNoDelay(false),
+		SocketLinger(0),
+		SocketSendBuffer(64 << 10),
+		SocketRecvBuffer(64 << 10),
+		SocketUserTimeout(9 * time.Second),
+		SocketTOS(0x10),
+		SocketFastOpen(16),
+	}
+	check := func(t *testing.T, conn stdnet.Conn, extra ...sockoptCheck) {
+		t.Helper()
+		checkSockopts(t, conn, append([]sockoptCheck{
+			{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1, 0},
+			{"TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, 42, 0},
+			{"TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 7, 0},
+			{"TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 3, 0},
+			{"TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 0, 0},
+			{"TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, tcpUserTimeout, 9000, 0},
+			{"IP_TOS", syscall.IPPROTO_IP, syscall.IP_TOS, 0x10, 0},
+			{"SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF, -1, 64 << 10}, // doubled by the kernel
+			{"SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF, -1, 64 << 10},
+		}, extra...)...)
+
+		var l *syscall.Linger
+		rawControl(t, conn, func(fd int) (err error) {
+			l, err = getsockoptLinger(fd)
+			return
+		})
+		if l.Onoff == 0 || l.Linger != 0 {
+			t.Errorf("SO_LINGER: expect on with 0s, but got %+v", *l)
+		}
+	}
+
+	var listener stdnet.Listener
+	accepted := make(chan stdnet.Conn, 1)
+	addr, _ := startTestServer(t,
+		WithServerSocketOptions(opts...),
+		WithServerOnListening(func(ss Server, l stdnet.Listener) {
+			listener = l
+		}),
+		WithServerOnClientConnected(func(w api.Response, ss Server) {
+			accepted <- baseConn(w.(*connS).conn.Load())
+		}),
+	)
+
+	c := NewClient(WithClientLogger(testLogger()), WithClientSocketOptions(opts...))
+	if err := c.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Run(context.Background())
+
+	t.Run("listener", func(t *testing.T) {
+		checkSockopts(t, listener, sockoptCheck{"TCP_FASTOPEN", syscall.IPPROTO_TCP, tcpFastOpen, 16, 0})
+	})
+	t.Run("client", func(t *testing.T) {
+		check(t, c.conn.Load(), sockoptCheck{"TCP_FASTOPEN_CONNECT", syscall.IPPROTO_TCP, tcpFastOpenConnect, 1, 0})
+	})
+	select {
+	case conn := <-accepted:
+		t.Run("server", func(t *testing.T) { check(t, conn) })
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the connection")
+	}
+}
+
+func TestSocketOptions_v6Only(t *testing.T) {
+	if l, err := stdnet.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("no IPv6:", err)
+	} else {
+		_ = l.Close()
+	}
+
+	// Go sets IPV6_V6ONLY on tcp6 sockets, the option overrides it
+	opts := []SocketOption{SocketV6Only(false), SocketNoKeepAlive()}
+	var listener stdnet.Listener
+	_, _ = startTestServer(t,
+		WithNetwork("tcp6"),
+		func(s *serverWrap) { s.address = "[::]:0" }, // binding a specific address sets IPV6_V6ONLY
+		WithServerSocketOptions(opts...),
+		WithServerOnListening(func(ss Server, l stdnet.Listener) {
+			listener = l
+		}),
+	)
+	checkSockopts(t, listener, sockoptCheck{"IPV6_V6ONLY", syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0, 0})
+
+	c := NewClient(WithClientLogger(testLogger()), WithClientSocketOptions(opts...))
+	if err := c.Dial("tcp6", stdnet.JoinHostPort("::1", strconv.Itoa(listener.Addr().(*stdnet.TCPAddr).Port))); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	checkSockopts(t, c.conn.Load(),
+		sockoptCheck{"IPV6_V6ONLY", syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0, 0},
+		sockoptCheck{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0, 0},
+	)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package net
+
+// TCP_USER_TIMEOUT and TCP Fast Open are unsupported.
+const (
+	tcpUserTimeout     = 0
+	tcpFastOpen        = 0
+	tcpFastOpenConnect = 0
+)
@@ -0,0 +1,11 @@
+//go:build unix
+
+package net
+
+import "syscall"
+
+const ipv6TClass = syscall.IPV6_TCLASS
+
+func setsockoptInt(fd uintptr, level, name, value int) error {
+	return syscall.SetsockoptInt(int(fd), level, name, value)
+}
@@ -0,0 +1,9 @@
+package net
+
+import "syscall"
+
+const ipv6TClass = 0x27 // IPV6_TCLASS of ws2ipdef.h
+
+func setsockoptInt(fd uintptr, level, name, value int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), level, name, value)
+}
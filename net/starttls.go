@@ -0,0 +1,187 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errStartTLSUnsupported = errors.New("StartTLS unsupported in reactor mode")
+	errAlreadyTLS          = errors.New("connection is TLS already")
+	errStartTLSResumable   = errors.New("StartTLS unsupported with session resumption")
+)
+
+// readPause parks the reading loop while StartTLS is replacing the
+// underlying connection.
+type readPause struct {
+	mu     sync.Mutex
+	parked chan struct{} // closed by the reading loop once it parked
+	resume chan struct{}
+}
+
+// pause wakes the reading loop up by a past read deadline, and waits
+// for it parked. done is closed if the reading loop ended. The pause
+// is given up if ctx is done, since the reading loop may be blocked
+// elsewhere, such as by a full worker pool queue.
+func (p *readPause) pause(ctx context.Context, conn net.Conn, done <-chan struct{}) (err error) {
+	p.mu.Lock()
+	parked := make(chan struct{})
+	p.parked, p.resume = parked, make(chan struct{})
+	p.mu.Unlock()
+
+	_ = conn.SetReadDeadline(aLongTimeAgo)
+	select {
+	case <-parked:
+	case <-done:
+		err = net.ErrClosed
+	case <-ctx.Done():
+		err = ctx.Err()
+		p.unpause() // the reading loop may be parking
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return
+}
+
+// unpause lets the reading loop go on.
+func (p *readPause) unpause() {
+	p.mu.Lock()
+	resume := p.resume
+	p.parked, p.resume = nil, nil
+	p.mu.Unlock()
+	if resume != nil {
+		close(resume)
+	}
+}
+
+// park is called by the reading loop after a read failed. It returns
+// true after a pause was requested and finished, then the reading
+// should be retried.
+func (p *readPause) park() bool {
+	p.mu.Lock()
+	parked, resume := p.parked, p.resume
+	p.mu.Unlock()
+	if parked == nil {
+		return false
+	}
+	close(parked)
+	<-resume
+	return true
+}
+
+// upgradeTLS holds the writing lock, performs the handshake over
+// *pconn, and replaces it with the TLS connection.
+func upgradeTLS(ctx context.Context, pconn *connRef, wl sync.Locker, handshake func(conn net.Conn) *tls.Conn) (err error) {
+	wl.Lock()
+	defer wl.Unlock()
+	conn := pconn.Load()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	tc := handshake(conn)
+	if err = tc.HandshakeContext(ctx); err == nil && !pconn.replace(conn, tc) {
+		err = net.ErrClosed // closed while handshaking
+	}
+	return
+}
+
+// StartTLS upgrades the connection to TLS as a server, see
+// api.TLSUpgrader.
+//
+// It is supported in Handler.Serve and in the data processing,
+// including the worker pool, but not in reactor mode.
+//
+// The bytes received in plaintext are never processed after the
+// upgrade: the rest of the data being processed, which the data
+// processor did not consume, and the chunks waiting in the worker
+// pool are discarded.
+func (s *connS) StartTLS(ctx context.Context, config *tls.Config) (err error) {
+	conn := s.conn.Load()
+	if conn == nil || s.Closed() {
+		return net.ErrClosed
+	}
+	if _, ok := conn.(*tls.Conn); ok {
+		return errAlreadyTLS
+	}
+	if s.inReactor() {
+		return errStartTLSUnsupported
+	}
+	if s.rs != nil {
+		return errStartTLSResumable
+	}
+
+	s.hj.mu.Lock()
+	looping := s.hj.looping
+	s.hj.mu.Unlock()
+
+	// the reading loop is the caller unless processing by workers
+	if looping && (s.pool != nil || atomic.LoadInt32(&s.hj.inProcess) == 0) {
+		if err = s.tp.pause(ctx, conn, s.hj.readDone); err != nil {
+			return
+		}
+		defer s.tp.unpause()
+	}
+
+	if err = s.flushQueued(ctx, looping, nil); err == nil {
+		err = upgradeTLS(ctx, &s.conn, s.wl, func(conn net.Conn) *tls.Conn { return tls.Server(conn, config) })
+	}
+	if err == nil {
+		atomic.AddInt32(&s.tlsGen, 1) // before the reading loop resumed
+	}
+	if err != nil {
+		s.Warn("[connS] StartTLS failed", "err", err)
+		s.Close()
+		return
+	}
+	s.Debug("[connS] StartTLS ok")
+	return
+}
+
+// StartTLS upgrades the connection to TLS as a client, see
+// api.TLSUpgrader. config.ServerName should be set unless
+// InsecureSkipVerify is true.
+//
+// It is supported in OnReading of the interceptor, or at any time
+// between the messages of the protocol.
+//
+// The interceptor of NewTypedClient discards the bytes received in
+// plaintext after the upgrade. A custom interceptor must drop the
+// rest of data, and the bytes it kept, once StartTLS returned.
+func (c *clientS) StartTLS(ctx context.Context, config *tls.Config) (err error) {
+	conn := c.conn.Load()
+	if conn == nil || c.Closed() {
+		return net.ErrClosed
+	}
+	if _, ok := conn.(*tls.Conn); ok {
+		return errAlreadyTLS
+	}
+
+	c.hj.mu.Lock()
+	looping := c.hj.looping
+	c.hj.mu.Unlock()
+
+	if looping && atomic.LoadInt32(&c.hj.inProcess) == 0 {
+		if err = c.tp.pause(ctx, conn, c.hj.readDone); err != nil {
+			return
+		}
+		defer c.tp.unpause()
+	}
+
+	if err = c.flushQueued(ctx, looping, nil); err == nil {
+		err = upgradeTLS(ctx, &c.conn, c.wl, func(conn net.Conn) *tls.Conn { return tls.Client(conn, config) })
+	}
+	if err == nil {
+		atomic.AddInt32(&c.tlsGen, 1) // before the reading loop resumed
+	}
+	if err != nil {
+		c.Warn("[client] StartTLS failed", "err", err)
+		c.Close()
+		return
+	}
+	c.Debug("[client] StartTLS ok")
+	return
+}
@@ -0,0 +1,341 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	stdnet "net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// testTLSConfigs returns the configs of a server with a self-signed
+// certificate for 127.0.0.1, and a client trusting it.
+func testTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []stdnet.IP{stdnet.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return
+}
+
+// startTLSProcessor echoes the lines, and upgrades the connection on
+// "STARTTLS".
+func startTLSProcessor(config *tls.Config) OnTcpServerProcessData {
+	return func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+		nn = len(data)
+		if string(data) != "STARTTLS\n" {
+			_, err = w.Write(append([]byte(nil), data...))
+			return
+		}
+		if _, err = w.Write([]byte("OK\n")); err != nil {
+			return
+		}
+		err = w.(api.TLSUpgrader).StartTLS(context.Background(), config)
+		return
+	}
+}
+
+func TestServer_startTLS(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	for _, tc := range []struct {
+		name string
+		opts []ServerOpt
+	}{
+		{"default", nil},
+		{"release-idle", []ServerOpt{WithServerReleaseIdleBuffer(true)}},
+		{"worker-pool", []ServerOpt{WithServerWorkerPool(2, 8, WorkerPoolOrdered)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, _ := startTestServer(t, append(tc.opts, WithServerOnProcessData(startTLSProcessor(serverConfig)))...)
+
+			conn, err := stdnet.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			scanner := bufio.NewScanner(conn)
+			for _, line := range []string{"hello", "STARTTLS"} {
+				if _, err = conn.Write([]byte(line + "\n")); err != nil {
+					t.Fatal(err)
+				}
+				if !scanner.Scan() {
+					t.Fatal(scanner.Err())
+				}
+			}
+			if scanner.Text() != "OK" {
+				t.Fatalf("expect OK, but got %q", scanner.Text())
+			}
+
+			tlsConn := tls.Client(conn, clientConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			scanner = bufio.NewScanner(tlsConn)
+			for _, line := range []string{"secret", "world"} {
+				if _, err = tlsConn.Write([]byte(line + "\n")); err != nil {
+					t.Fatal(err)
+				}
+				if !scanner.Scan() {
+					t.Fatal(scanner.Err())
+				}
+				if scanner.Text() != line {
+					t.Fatalf("expect %q, but got %q", line, scanner.Text())
+				}
+			}
+		})
+	}
+}
+
+// lineCollector is a client interceptor collecting the incoming data,
+// and counting the outgoing messages.
+type lineCollector struct {
+	lines   chan string
+	written int32
+}
+
+func (l *lineCollector) OnReading(ctx context.Context, conn api.Conn, data []byte, ch chan<- []byte) (processed bool, err error) {
+	l.lines <- string(data)
+	return true, nil
+}
+
+func (l *lineCollector) OnWriting(ctx context.Context, conn api.Conn, data []byte) (processed bool, err error) {
+	atomic.AddInt32(&l.written, 1)
+	return
+}
+
+func TestClient_startTLS(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	addr, _ := startTestServer(t, WithServerOnProcessData(startTLSProcessor(serverConfig)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lc := &lineCollector{lines: make(chan string, 8)}
+	c := NewClient(WithClientLogger(testLogger()), WithClientInterceptor(lc))
+	if err := c.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Run(ctx)
+
+	expect := func(line string) {
+		t.Helper()
+		select {
+		case got := <-lc.lines:
+			if got != line {
+				t.Fatalf("expect %q, but got %q", line, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", line)
+		}
+	}
+
+	if _, err := c.Write([]byte("STARTTLS\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("OK\n")
+	if err := c.StartTLS(ctx, clientConfig); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("secret\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect("secret\n")
+	if got := atomic.LoadInt32(&lc.written); got != 2 {
+		t.Fatalf("expect 2 messages through OnWriting, but got %d", got)
+	}
+}
+
+func TestServer_startTLSDiscardsPlaintext(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	handler := func(ctx context.Context, conn TypedConn[string], msg string) error {
+		if err := conn.Send(msg); err != nil || msg != "STARTTLS" {
+			return err
+		}
+		c, _ := ConnFromContext(ctx)
+		return c.(api.TLSUpgrader).StartTLS(ctx, serverConfig)
+	}
+	for _, tc := range []struct {
+		name string
+		opts []ServerOpt
+	}{
+		{"default", nil},
+		{"worker-pool", []ServerOpt{WithServerWorkerPool(2, 8, WorkerPoolOrdered)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, _ := startTestServer(t, append(tc.opts, WithServerOnProcessData(typedProcessor[string](LineCodec{}, handler)))...)
+
+			conn, err := stdnet.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// the injected line follows STARTTLS in the same segment
+			if _, err = conn.Write([]byte("STARTTLS\ninjected\n")); err != nil {
+				t.Fatal(err)
+			}
+			scanner := bufio.NewScanner(conn)
+			if !scanner.Scan() || scanner.Text() != "STARTTLS" {
+				t.Fatalf("expect STARTTLS, but got %q, %v", scanner.Text(), scanner.Err())
+			}
+
+			tlsConn := tls.Client(conn, clientConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = tlsConn.Write([]byte("secret\n")); err != nil {
+				t.Fatal(err)
+			}
+			scanner = bufio.NewScanner(tlsConn)
+			if !scanner.Scan() || scanner.Text() != "secret" {
+				t.Fatalf("expect secret only, but got %q, %v", scanner.Text(), scanner.Err())
+			}
+		})
+	}
+}
+
+func TestTypedClient_startTLSDiscardsPlaintext(t *testing.T) {
+	serverConfig, clientConfig := testTLSConfigs(t)
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "STARTTLS\n" {
+			return
+		}
+		// the injected line follows the reply in the same segment
+		if _, err = conn.Write([]byte("OK\ninjected\n")); err != nil {
+			return
+		}
+		tlsConn := tls.Server(conn, serverConfig)
+		line, err := bufio.NewReader(tlsConn).ReadString('\n')
+		if err == nil {
+			_, _ = tlsConn.Write([]byte(line))
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lines := make(chan string, 8)
+	var c *TypedClient[string]
+	c = NewTypedClient[string](LineCodec{}, func(ctx context.Context, conn TypedConn[string], msg string) error {
+		var err error
+		if msg == "OK" {
+			err = c.StartTLS(ctx, clientConfig)
+		}
+		lines <- msg
+		return err
+	}, WithClientLogger(testLogger()))
+	if err = c.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Run(ctx)
+
+	if err = c.Send("STARTTLS"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"OK", "secret"} {
+		select {
+		case got := <-lines:
+			if got != expect {
+				t.Fatalf("expect %q, but got %q", expect, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", expect)
+		}
+		if expect == "OK" {
+			if err = c.Send("secret"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestServer_startTLSBlockedReading(t *testing.T) {
+	serverConfig, _ := testTLSConfigs(t)
+	result := make(chan error, 1)
+	addr, _ := startTestServer(t,
+		WithServerWorkerPool(1, 1, WorkerPoolOrdered),
+		WithServerOnProcessData(func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+			nn = len(data)
+			if string(data) != "STARTTLS\n" {
+				return
+			}
+			time.Sleep(100 * time.Millisecond) // the reading loop gets blocked by the full queue
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			err = w.(api.TLSUpgrader).StartTLS(ctx, serverConfig)
+			result <- err
+			return
+		}),
+	)
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write([]byte("STARTTLS\n"))
+	for i := 0; i < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = conn.Write([]byte("more\n"))
+	}
+
+	select {
+	case err = <-result:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expect DeadlineExceeded, but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("StartTLS is blocked by the reading loop")
+	}
+}
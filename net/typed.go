@@ -0,0 +1,190 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// ErrIncompleteFrame can be returned by OnTcpServerProcessData with
+// nn = 0, to keep the pending bytes and wait for more. A frame cannot
+// be longer than WithServerMaxMessageLength, or
+// WithClientMaxMessageLength for NewTypedClient.
+var ErrIncompleteFrame = errors.New("incomplete frame")
+
+var errFrameTooLarge = errors.New("frame too large")
+
+// TypedCodec converts between the byte frames and the messages of
+// type M.
+type TypedCodec[M any] interface {
+	// Decode decodes the first message in data, and returns how many
+	// bytes it consumed. It returns ErrIncompleteFrame if data holds
+	// a partial message only.
+	//
+	// data is owned by the reading loop, msg must not refer to it.
+	Decode(data []byte) (msg M, n int, err error)
+	// Encode appends the frame of msg to buf.
+	Encode(buf []byte, msg M) ([]byte, error)
+}
+
+// TypedConn is the connection passed to TypedHandler, which sends
+// the typed messages.
+type TypedConn[M any] interface {
+	api.Response
+	// Send encodes msg and puts it into the writing queue.
+	Send(msg M) error
+}
+
+// TypedHandler handles a decoded message. Returning an error closes
+// the connection.
+type TypedHandler[M any] func(ctx context.Context, conn TypedConn[M], msg M) error
+
+// NewTypedServer makes a server of the typed messages. The incoming
+// bytes are split and decoded by codec, and each message is handed to
+// handler with the per-connection context.
+//
+// It is a NewServer with the data processor, so opts, the middlewares
+// and the worker pool work as usual, except WithServerOnProcessData.
+func NewTypedServer[M any](addr string, codec TypedCodec[M], handler TypedHandler[M], opts ...ServerOpt) *serverWrap {
+	return NewServer(addr, append(opts, WithServerOnProcessData(typedProcessor(codec, handler)))...)
+}
+
+func typedProcessor[M any](codec TypedCodec[M], handler TypedHandler[M]) OnTcpServerProcessData {
+	return func(data []byte, w api.Response, r api.Request) (nn int, err error) {
+		ctx := ContextOf(w)
+		tc := &typedConn[M]{Response: w, codec: codec}
+		gen := tlsGenOf(w)
+		for nn < len(data) && tlsGenOf(w) == gen { // the rest is plaintext after StartTLS
+			var msg M
+			var n int
+			if msg, n, err = codec.Decode(data[nn:]); err != nil || n <= 0 {
+				if nn > 0 && (err == nil || errors.Is(err, ErrIncompleteFrame)) {
+					err = nil // the processed ones go first
+				} else if err == nil {
+					err = ErrIncompleteFrame
+				}
+				return
+			}
+			nn += n
+			if err = handler(ctx, tc, msg); err != nil {
+				return
+			}
+		}
+		return
+	}
+}
+
+type typedConn[M any] struct {
+	api.Response
+	codec TypedCodec[M]
+}
+
+func (t *typedConn[M]) Send(msg M) (err error) {
+	var data []byte
+	if data, err = t.codec.Encode(nil, msg); err == nil {
+		_, err = t.Write(data)
+	}
+	return
+}
+
+// TypedClient is a client of the typed messages, see NewTypedClient.
+type TypedClient[M any] struct {
+	Client
+	codec TypedCodec[M]
+}
+
+// NewTypedClient makes a client of the typed messages. The incoming
+// bytes are split and decoded by codec, and each message is handed to
+// handler.
+//
+// It installs an interceptor to decode the messages, so the one of
+// WithClientInterceptor is replaced.
+func NewTypedClient[M any](codec TypedCodec[M], handler TypedHandler[M], opts ...ClientOpt) *TypedClient[M] {
+	ti := &typedInterceptor[M]{codec: codec, handler: handler}
+	return &TypedClient[M]{
+		Client: NewClient(append(opts, WithClientInterceptor(ti))...),
+		codec:  codec,
+	}
+}
+
+// Send encodes msg and puts it into the sending queue.
+func (c *TypedClient[M]) Send(msg M) (err error) {
+	var data []byte
+	if data, err = c.codec.Encode(nil, msg); err == nil {
+		_, err = c.Write(data)
+	}
+	return
+}
+
+// typedInterceptor decodes the incoming bytes of a client, keeping
+// the partial message till more bytes arrived.
+type typedInterceptor[M any] struct {
+	codec   TypedCodec[M]
+	handler TypedHandler[M]
+	pending []byte
+	tlsGen  int32 // the tlsGen of the client when pending kept
+}
+
+func (t *typedInterceptor[M]) OnReading(ctx context.Context, conn api.Conn, data []byte, ch chan<- []byte) (processed bool, err error) {
+	gen := tlsGenOf(conn)
+	if gen != t.tlsGen {
+		t.pending, t.tlsGen = t.pending[:0], gen // plaintext kept before StartTLS
+	}
+	buf := data
+	if len(t.pending) > 0 {
+		buf = append(t.pending, data...)
+	}
+	tc := &typedConn[M]{Response: conn, codec: t.codec}
+	for len(buf) > 0 && tlsGenOf(conn) == gen {
+		msg, n, e := t.codec.Decode(buf)
+		if errors.Is(e, ErrIncompleteFrame) || e == nil && n <= 0 {
+			break
+		} else if e != nil {
+			return true, e
+		}
+		buf = buf[n:]
+		if err = t.handler(ctx, tc, msg); err != nil {
+			return true, err
+		}
+	}
+	if c, ok := conn.(*clientS); ok && len(buf) > c.bufferSize {
+		t.pending = t.pending[:0]
+		return true, errFrameTooLarge
+	}
+	t.pending = append(t.pending[:0], buf...) // buf may be data, which is reused by the reading loop
+	return true, nil
+}
+
+// tlsGenOf returns the count of StartTLS upgrades of a connection.
+func tlsGenOf(conn any) int32 {
+	switch c := conn.(type) {
+	case *connS:
+		return atomic.LoadInt32(&c.tlsGen)
+	case *clientS:
+		return atomic.LoadInt32(&c.tlsGen)
+	}
+	return 0
+}
+
+func (t *typedInterceptor[M]) OnWriting(ctx context.Context, conn api.Conn, data []byte) (processed bool, err error) {
+	return
+}
+
+// LineCodec is a TypedCodec of the text lines, ending with "\n". The
+// trailing "\r" is trimmed while decoding.
+type LineCodec struct{}
+
+func (LineCodec) Decode(data []byte) (msg string, n int, err error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return "", 0, ErrIncompleteFrame
+	}
+	return string(bytes.TrimSuffix(data[:i], []byte("\r"))), i + 1, nil
+}
+
+func (LineCodec) Encode(buf []byte, msg string) ([]byte, error) {
+	return append(append(buf, msg...), '\n'), nil
+}
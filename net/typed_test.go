@@ -0,0 +1,119 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"io"
+	stdnet "net"
+	"testing"
+	"time"
+)
+
+func startTypedEchoServer(t *testing.T) (addr string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewTypedServer[string]("127.0.0.1:0", LineCodec{},
+		func(ctx context.Context, conn TypedConn[string], msg string) error {
+			return conn.Send("echo:" + msg)
+		},
+		WithServerQuiet(true),
+		WithServerLogger(testLogger()),
+		WithServerOnListening(func(ss Server, l stdnet.Listener) { addr = l.Addr().String() }),
+	)
+	if err := s.Start(ctx); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		_ = s.Stop()
+	})
+	return
+}
+
+func TestTypedServer(t *testing.T) {
+	addr := startTypedEchoServer(t)
+	conn, scanner := dialLines(t, addr)
+
+	// a message split across writes, and two messages in one write
+	for _, chunk := range []string{"hel", "lo\r\n", "a\nb\n"} {
+		if _, err := conn.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectLines(t, scanner, "echo:hello", "echo:a", "echo:b")
+}
+
+func TestTypedClient(t *testing.T) {
+	addr := startTypedEchoServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	got := make(chan string, 4)
+	c := NewTypedClient[string](LineCodec{}, func(ctx context.Context, conn TypedConn[string], msg string) error {
+		got <- msg
+		return nil
+	}, WithClientLogger(testLogger()))
+	if err := c.Dial("tcp", addr); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Run(ctx)
+
+	for _, msg := range []string{"foo", "bar"} {
+		if err := c.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case m := <-got:
+			if m != "echo:"+msg {
+				t.Fatalf("expect %q, but got %q", "echo:"+msg, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestTypedClient_frameTooLarge(t *testing.T) {
+	ln, err := stdnet.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	closed := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			closed <- err
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// a line never ends, in several writes
+		for i := 0; i < 4; i++ {
+			if _, err = conn.Write([]byte("0123456789")); err != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		_, err = conn.Read(make([]byte, 1))
+		closed <- err
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewTypedClient[string](LineCodec{}, func(ctx context.Context, conn TypedConn[string], msg string) error {
+		return nil
+	}, WithClientLogger(testLogger()), WithClientMaxMessageLength(16))
+	if err = c.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Run(ctx)
+
+	if err = <-closed; !errors.Is(err, io.EOF) {
+		t.Fatalf("expect the client closed the connection, but got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package net
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+var errSocketInUse = errors.New("unix socket in use by another server")
+
+// WithServerUnixSocketMode sets the file mode of the socket file of a
+// unix or unixpacket server, such as 0660, right after listening. Put
+// the socket in a directory restricted as well if the moment before
+// that matters.
+func WithServerUnixSocketMode(mode os.FileMode) ServerOpt {
+	return func(s *serverWrap) {
+		s.unixMode = mode
+	}
+}
+
+// WithServerUnixSocketOwner sets the owner and group of the socket
+// file of a unix or unixpacket server after listening. -1 keeps the
+// one. It usually needs the privileges.
+func WithServerUnixSocketOwner(uid, gid int) ServerOpt {
+	return func(s *serverWrap) {
+		s.unixUID, s.unixGID, s.unixOwner = uid, gid, true
+	}
+}
+
+// PeerCred returns the credentials of the client process of a unix
+// domain socket, see api.PeerCredentials.
+func (s *connS) PeerCred() (cred api.PeerCred, err error) {
+	conn := s.conn.Load()
+	if conn == nil {
+		return cred, net.ErrClosed
+	}
+	return peerCred(baseConn(conn))
+}
+
+// PeerCred returns the credentials of the server process of a unix
+// domain socket, see api.PeerCredentials.
+func (c *clientS) PeerCred() (cred api.PeerCred, err error) {
+	conn := c.conn.Load()
+	if conn == nil {
+		return cred, net.ErrClosed
+	}
+	return peerCred(baseConn(conn))
+}
+
+func isUnixStream(network string) bool {
+	return network == "unix" || network == "unixpacket"
+}
+
+// isAbstractAddr tells whether addr is in the abstract namespace of
+// Linux, such as "@name", which has no file.
+func isAbstractAddr(addr string) bool {
+	return len(addr) > 0 && addr[0] == '@' && (runtime.GOOS == "linux" || runtime.GOOS == "android")
+}
+
+// removeStaleSocket removes the socket file left by a dead server, so
+// that the listening does not fail. A socket file in use is kept.
+func (s *serverWrap) removeStaleSocket() error {
+	if isAbstractAddr(s.address) {
+		return nil
+	}
+	if fi, err := os.Lstat(s.address); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return nil // nothing there, or not a socket, let Listen tell
+	}
+	conn, err := net.DialTimeout(s.network, s.address, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return errSocketInUse
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	s.Warn("[serverWrap] removing stale unix socket", "path", s.address)
+	return os.Remove(s.address)
+}
+
+// setupUnixSocket applies the file mode and owner of the socket file.
+func (s *serverWrap) setupUnixSocket() (err error) {
+	if isAbstractAddr(s.address) {
+		return
+	}
+	if s.unixMode != 0 {
+		err = os.Chmod(s.address, s.unixMode)
+	}
+	if err == nil && s.unixOwner {
+		err = os.Chown(s.address, s.unixUID, s.unixGID)
+	}
+	return
+}
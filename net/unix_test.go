@@ -0,0 +1,102 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	stdnet "net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// peerCredProcessor replies the pid of the peer to each line.
+func peerCredProcessor(data []byte, w api.Response, r api.Request) (nn int, err error) {
+	cred, err := w.(api.Conn).PeerCred()
+	if err != nil {
+		return
+	}
+	_, err = w.Write([]byte(fmt.Sprintf("%d\n", cred.PID)))
+	return len(data), err
+}
+
+// startUnixTestServer starts a unix server listening at path.
+func startUnixTestServer(t *testing.T, path string, opts ...ServerOpt) *serverWrap {
+	t.Helper()
+	_, s := startTestServer(t, append(opts, WithNetwork("unix"), func(s *serverWrap) { s.address = path })...)
+	return s
+}
+
+func TestServer_unixPeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are supported on linux only")
+	}
+	for _, tc := range []struct{ name, path string }{
+		{"file", filepath.Join(t.TempDir(), "cred.sock")},
+		{"abstract", fmt.Sprintf("@go-socketlib-test-%d", os.Getpid())},
+	} {
+		path := tc.path
+		t.Run(tc.name, func(t *testing.T) {
+			startUnixTestServer(t, path, WithServerOnProcessData(peerCredProcessor))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			lc := &lineCollector{lines: make(chan string, 8)}
+			c := NewClient(WithClientLogger(testLogger()), WithClientInterceptor(lc))
+			if err := c.Dial("unix", path); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.Run(ctx)
+
+			if cred, err := c.PeerCred(); err != nil || cred.PID != os.Getpid() {
+				t.Fatalf("expect the server pid %d, but got %v, %v", os.Getpid(), cred, err)
+			}
+			_, _ = c.Write([]byte("pid\n"))
+			select {
+			case got := <-lc.lines:
+				if got != fmt.Sprintf("%d\n", os.Getpid()) {
+					t.Fatalf("expect the client pid %d, but got %q", os.Getpid(), got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+		})
+	}
+}
+
+func TestServer_unixSocketFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.sock")
+
+	// a socket file left by a dead server
+	l, err := stdnet.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*stdnet.UnixListener).SetUnlinkOnClose(false)
+	_ = l.Close()
+
+	startUnixTestServer(t, path, WithServerUnixSocketMode(0o600), WithServerOnProcessData(echoProcessor))
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("expect mode 0600, but got %v, %v", fi.Mode(), err)
+	}
+	conn, err := stdnet.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte("hello\n"))
+	expectLines(t, bufio.NewScanner(conn), "hello")
+
+	// the socket file in use is kept
+	s := NewServer(path, WithNetwork("unix"), WithServerLogger(testLogger()))
+	if err = s.Listen(context.Background()); !errors.Is(err, errSocketInUse) {
+		t.Fatalf("expect errSocketInUse, but got %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+package net
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+	"github.com/hedzr/go-socketlib/net/bufpool"
+)
+
+// WorkerPoolMode tells how a worker pool orders the incoming data.
+type WorkerPoolMode int
+
+const (
+	// WorkerPoolOrdered processes the data of a connection one by
+	// one in arrival order, by a keyed queue per connection. The
+	// unprocessed bytes are kept for the next data as usual, so it
+	// works for any framing.
+	WorkerPoolOrdered WorkerPoolMode = iota
+	// WorkerPoolConcurrent processes each read chunk independently
+	// and concurrently, even for the same connection. The bytes not
+	// consumed by OnProcessData are dropped, so it fits the
+	// protocols which receive a whole message by one read.
+	WorkerPoolConcurrent
+)
+
+func (m WorkerPoolMode) String() string {
+	switch m {
+	case WorkerPoolOrdered:
+		return "ordered"
+	case WorkerPoolConcurrent:
+		return "concurrent"
+	}
+	return "unknown"
+}
+
+// WithServerWorkerPool runs OnProcessData in a bounded pool of
+// workers instead of the reading goroutine of each connection, so
+// that a CPU-heavy processor has a global concurrency limit.
+//
+// workers is the count of workers, 0 means the number of CPUs.
+// queueSize bounds the pending chunks; the reading blocks while the
+// queue is full. In ordered mode it bounds the pending chunks of
+// each connection too, and the unprocessed bytes kept per connection
+// to queueSize reads.
+//
+// The time a chunk waited in the queue is recorded, see
+// WorkerPoolStats.
+func WithServerWorkerPool(workers, queueSize int, mode WorkerPoolMode) ServerOpt {
+	return func(s *serverWrap) {
+		if workers <= 0 {
+			workers = runtime.NumCPU()
+		}
+		if queueSize <= 0 {
+			queueSize = defaultWorkerQueueSize
+		}
+		s.wpWorkers, s.wpQueueSize, s.wpMode = workers, queueSize, mode
+	}
+}
+
+const defaultWorkerQueueSize = 256
+
+// WorkerPoolStats is a snapshot of the worker pool statistics.
+type WorkerPoolStats struct {
+	Workers   int
+	Queued    int           // the chunks waiting for a worker now
+	Processed int64         // the chunks processed
+	TotalWait time.Duration // the sum of queue-wait time of processed chunks
+	MaxWait   time.Duration // the longest queue-wait time
+}
+
+// AvgWait returns the average queue-wait time.
+func (st WorkerPoolStats) AvgWait() time.Duration {
+	if st.Processed == 0 {
+		return 0
+	}
+	return st.TotalWait / time.Duration(st.Processed)
+}
+
+// WorkerPoolStats returns the statistics of the worker pool, or a
+// zero value if the worker pool is disabled.
+func (s *serverWrap) WorkerPoolStats() (st WorkerPoolStats) {
+	if p := s.pool; p != nil {
+		st = WorkerPoolStats{
+			Workers:   p.workers,
+			Queued:    int(atomic.LoadInt64(&p.queued)),
+			Processed: atomic.LoadInt64(&p.processed),
+			TotalWait: time.Duration(atomic.LoadInt64(&p.waitTotal)),
+			MaxWait:   time.Duration(atomic.LoadInt64(&p.waitMax)),
+		}
+	}
+	return
+}
+
+// poolItem is a read chunk waiting for a worker.
+type poolItem struct {
+	c     *connS
+	w     api.Response
+	r     api.Request
+	frame bufpool.Frame
+	at    time.Time // when enqueued
+	gen   int32     // the tlsGen of c when read
+}
+
+// procState is the per-connection keyed queue and framing state in
+// ordered mode.
+type procState struct {
+	ch        chan poolItem
+	scheduled int32 // 1 while the connection is queued or being processed
+	buf       []byte
+	pos       int
+}
+
+type workerPool struct {
+	workers int
+	mode    WorkerPoolMode
+	size    int
+	items   chan poolItem // concurrent mode
+	conns   chan *connS   // ordered mode, the connections having pending chunks
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+
+	queued    int64
+	processed int64
+	waitTotal int64
+	waitMax   int64
+}
+
+func newWorkerPool(workers, queueSize int, mode WorkerPoolMode) *workerPool {
+	p := &workerPool{
+		workers: workers,
+		mode:    mode,
+		size:    queueSize,
+		done:    make(chan struct{}),
+	}
+	if mode == WorkerPoolOrdered {
+		p.conns = make(chan *connS, queueSize)
+	} else {
+		p.items = make(chan poolItem, queueSize)
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) close() {
+	p.once.Do(func() {
+		close(p.done)
+		p.wg.Wait()
+	})
+}
+
+// submit queues a copy of data of c. It blocks while the queue is
+// full, and returns false if ctx is done or the pool closed.
+func (p *workerPool) submit(ctx context.Context, c *connS, data []byte, w api.Response, r api.Request) bool {
+	item := poolItem{c: c, w: w, r: r, frame: bufpool.Clone(data), at: time.Now(), gen: atomic.LoadInt32(&c.tlsGen)}
+	if p.mode == WorkerPoolConcurrent {
+		return p.push(ctx, p.items, item)
+	}
+
+	ps := c.proc
+	if !p.push(ctx, ps.ch, item) {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&ps.scheduled, 0, 1) {
+		select {
+		case p.conns <- c:
+		case <-ctx.Done():
+			return false
+		case <-p.done:
+			return false
+		}
+	}
+	return true
+}
+
+func (p *workerPool) push(ctx context.Context, ch chan poolItem, item poolItem) bool {
+	atomic.AddInt64(&p.queued, 1)
+	select {
+	case ch <- item:
+		return true
+	case <-ctx.Done():
+	case <-p.done:
+	}
+	atomic.AddInt64(&p.queued, -1)
+	item.frame.Release()
+	return false
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.done:
+			return
+		case item := <-p.items:
+			p.processChunk(item)
+		case c := <-p.conns:
+			p.processConn(c)
+		}
+	}
+}
+
+// fairness is how many chunks of a connection a worker processes
+// before giving other connections a chance.
+const fairness = 16
+
+// processConn processes the pending chunks of c in order.
+func (p *workerPool) processConn(c *connS) {
+	ps := c.proc
+	for {
+		for i := 0; i < fairness; i++ {
+			select {
+			case item := <-ps.ch:
+				p.processOrdered(item)
+				continue
+			default:
+			}
+
+			atomic.StoreInt32(&ps.scheduled, 0)
+			if len(ps.ch) == 0 || !atomic.CompareAndSwapInt32(&ps.scheduled, 0, 1) {
+				return
+			}
+		}
+
+		select {
+		case p.conns <- c: // requeue it behind the others
+			return
+		default: // the queue is full, keep going
+		}
+	}
+}
+
+func (p *workerPool) processOrdered(item poolItem) {
+	p.record(item)
+	c, ps := item.c, item.c.proc
+	defer c.processed()
+	defer item.frame.Release()
+	defer c.recoverPanic("worker")
+	if c.Closed() || c.plaintextAfterTLS(item) {
+		return
+	}
+
+	n := len(item.frame)
+	if need := ps.pos + n; need > p.size*c.bufferSize {
+		c.handleError(errFrameTooLarge, "[connS] unprocessed bytes overflowed the worker pool queue", "client.addr", c.RemoteAddrString(), "bytes", need)
+		c.Close()
+		bufpool.Put(ps.buf)
+		ps.buf, ps.pos = nil, 0
+		return
+	} else if need > len(ps.buf) {
+		buf := bufpool.Get(max(need, c.bufferSize*2))
+		copy(buf, ps.buf[:ps.pos])
+		bufpool.Put(ps.buf)
+		ps.buf = buf
+	}
+	copy(ps.buf[ps.pos:], item.frame)
+
+	var ok bool
+	if ps.pos, ok = c.consume(ps.buf, ps.pos, n, item.w, item.r); !ok {
+		c.Close()
+	}
+	if ps.pos == 0 {
+		bufpool.Put(ps.buf)
+		ps.buf = nil
+	}
+}
+
+func (p *workerPool) processChunk(item poolItem) {
+	p.record(item)
+	c := item.c
+	defer c.processed()
+	defer item.frame.Release()
+	defer c.recoverPanic("worker")
+	if c.Closed() || c.plaintextAfterTLS(item) {
+		return
+	}
+
+	next, ok := c.consume(item.frame, 0, len(item.frame), item.w, item.r)
+	if !ok {
+		c.Close()
+	} else if next > 0 {
+		c.Warn("[connS] unconsumed bytes dropped in concurrent worker pool", "client.addr", c.RemoteAddrString(), "bytes", next)
+	}
+}
+
+func (p *workerPool) record(item poolItem) {
+	atomic.AddInt64(&p.queued, -1)
+	atomic.AddInt64(&p.processed, 1)
+	wait := int64(time.Since(item.at))
+	atomic.AddInt64(&p.waitTotal, wait)
+	for {
+		m := atomic.LoadInt64(&p.waitMax)
+		if wait <= m || atomic.CompareAndSwapInt64(&p.waitMax, m, wait) {
+			return
+		}
+	}
+}
+
+// plaintextAfterTLS reports whether item was read before StartTLS
+// upgraded the connection. Such a chunk is discarded.
+func (s *connS) plaintextAfterTLS(item poolItem) bool {
+	if item.gen == atomic.LoadInt32(&s.tlsGen) {
+		return false
+	}
+	s.Warn("[connS] plaintext after StartTLS discarded", "bytes", len(item.frame))
+	return true
+}
+
+// dispatch processes buf[pos:pos+n] inline by consume, or hands a
+// copy of it over to the worker pool. In the latter case, the next
+// position is always 0 since the pool keeps the framing state.
+func (s *connS) dispatch(buf []byte, pos, n int, w api.Response, r api.Request) (next int, ok bool) {
+	p := s.pool
+	if p == nil {
+		return s.consume(buf, pos, n, w, r)
+	}
+	atomic.AddInt64(&s.busy, 1)
+	if !p.submit(s.connCtx(), s, buf[pos:pos+n], w, r) {
+		atomic.AddInt64(&s.busy, -1)
+		return 0, false
+	}
+	return 0, true
+}
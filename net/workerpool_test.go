@@ -0,0 +1,131 @@
+package net
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	stdnet "net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+// lineProcessor echoes the complete lines. The partial line is kept
+// by a corrupt data finder which eats nothing.
+func lineProcessor(data []byte, w api.Response, r api.Request) (nn int, err error) {
+	if i := strings.LastIndexByte(string(data), '\n'); i >= 0 {
+		nn = i + 1
+		_, err = w.Write(append([]byte(nil), data[:nn]...))
+		return
+	}
+	return
+}
+
+func TestServer_workerPoolOrdered(t *testing.T) {
+	addr, s := startTestServer(t,
+		WithServerWorkerPool(4, 8, WorkerPoolOrdered),
+		WithServerOnProcessData(lineProcessor),
+		WithServerOnCorruptData(func(data []byte, w api.Response, r api.Request) (ate int) { return 0 }),
+	)
+
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const lines = 200
+	go func() {
+		for i := 0; i < lines; i++ {
+			// split a line across writes to check the framing state
+			_, _ = conn.Write([]byte("line "))
+			_, _ = conn.Write([]byte(strings.Repeat("x", i%7) + "\n"))
+		}
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	for i := 0; i < lines; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("line %d: %v", i, scanner.Err())
+		}
+		if got, expect := scanner.Text(), "line "+strings.Repeat("x", i%7); got != expect {
+			t.Fatalf("line %d: expect %q, but got %q", i, expect, got)
+		}
+	}
+
+	if st := s.WorkerPoolStats(); st.Workers != 4 || st.Processed == 0 || st.MaxWait < st.AvgWait() {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestServer_workerPoolConcurrent(t *testing.T) {
+	addr, s := startTestServer(t,
+		WithServerWorkerPool(2, 4, WorkerPoolConcurrent),
+		WithServerOnProcessData(echoProcessor),
+	)
+	testEcho(t, addr, 10)
+	if st := s.WorkerPoolStats(); st.Processed == 0 || st.Queued != 0 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+func TestServer_workerPoolOrderedOverflow(t *testing.T) {
+	addr, _ := startTestServer(t,
+		func(s *serverWrap) { s.bufferSize = 64 },
+		WithServerWorkerPool(1, 2, WorkerPoolOrdered),
+		WithServerOnProcessData(lineProcessor),
+		WithServerOnCorruptData(func(data []byte, w api.Response, r api.Request) (ate int) { return 0 }),
+	)
+	conn, err := stdnet.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go func() {
+		for i := 0; i < 16; i++ { // no line ends, kept till overflowed
+			if _, err := conn.Write([]byte(strings.Repeat("x", 32))); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expect the connection closed, but got %v", err)
+	}
+}
+
+func TestServer_restartWorkerPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listening := make(chan string, 2)
+	s := NewServer("127.0.0.1:0",
+		WithServerQuiet(true),
+		WithServerLogger(testLogger()),
+		WithServerWorkerPool(2, 8, WorkerPoolOrdered),
+		WithServerOnProcessData(echoProcessor),
+		WithServerOnListening(func(ss Server, l stdnet.Listener) {
+			if l != nil {
+				listening <- l.Addr().String()
+			}
+		}),
+	)
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	testEcho(t, <-listening, 10)
+
+	go func() { _ = s.Restart(ctx) }() // serves till ctx done
+	select {
+	case addr := <-listening:
+		testEcho(t, addr, 10)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the restart")
+	}
+}
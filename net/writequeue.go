@@ -0,0 +1,409 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+	"github.com/hedzr/go-socketlib/net/bufpool"
+)
+
+const defaultWriteQueueSize = 16
+
+const defaultWriteBatchSize = 64
+
+// WriteQueuePolicy decides what a cached Write does while the
+// writing queue of a connection is full.
+type WriteQueuePolicy int
+
+const (
+	// WriteQueueBlock blocks the producer till the queue has room,
+	// the context is done, or the connection is closed.
+	WriteQueueBlock WriteQueuePolicy = iota
+	// WriteQueueDropNewest discards the message being written and
+	// returns api.ErrWriteQueueFull.
+	WriteQueueDropNewest
+	// WriteQueueDropOldest discards the oldest queued message to
+	// make room for the new one.
+	WriteQueueDropOldest
+	// WriteQueueDisconnect closes the slow consumer and returns
+	// api.ErrWriteQueueFull.
+	WriteQueueDisconnect
+)
+
+func (p WriteQueuePolicy) String() string {
+	switch p {
+	case WriteQueueBlock:
+		return "block"
+	case WriteQueueDropNewest:
+		return "drop-newest"
+	case WriteQueueDropOldest:
+		return "drop-oldest"
+	case WriteQueueDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// writeReq is a message in the writing queue, and it is also the
+// completion handle of the cached write.
+type writeReq struct {
+	data   []byte
+	pooled bool // data is owned by bufpool
+	cb     func(n int, err error)
+	done   chan struct{} // nil if nobody waits for the completion
+	n      int
+	err    error
+}
+
+var poolWriteReq = sync.Pool{New: func() any { return new(writeReq) }}
+
+func newWriteReq(data []byte, wait bool, cb func(n int, err error)) *writeReq {
+	r := poolWriteReq.Get().(*writeReq)
+	r.data, r.cb = data, cb
+	if wait {
+		r.done = make(chan struct{})
+	}
+	return r
+}
+
+// newPooledWriteReq copies data into a pooled buffer so that the
+// caller can reuse data once the cached writing returned.
+func newPooledWriteReq(data []byte, wait bool, cb func(n int, err error)) *writeReq {
+	r := newWriteReq(bufpool.Clone(data), wait, cb)
+	r.pooled = true
+	return r
+}
+
+// resolve settles the request. It must be called exactly once.
+//
+// The pooled data buffer is released here, and a request without
+// any waiter is recycled too.
+func (r *writeReq) resolve(n int, err error) {
+	r.n, r.err = n, err
+	if r.pooled {
+		bufpool.Put(r.data)
+	}
+	r.data, r.pooled = nil, false
+	if r.cb != nil {
+		r.cb(n, err)
+	}
+	if r.done != nil {
+		close(r.done)
+		return
+	}
+	if r.cb == nil {
+		poolWriteReq.Put(r)
+	}
+}
+
+func (r *writeReq) Done() <-chan struct{}      { return r.done }
+func (r *writeReq) Result() (n int, err error) { return r.n, r.err }
+
+func (r *writeReq) Wait(ctx context.Context) (n int, err error) {
+	select {
+	case <-r.done:
+		return r.n, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// resolvedWrite returns a completion handle settled already.
+func resolvedWrite(n int, err error) api.WriteCompletion {
+	r := newWriteReq(nil, true, nil)
+	r.resolve(n, err)
+	return r
+}
+
+// writeQueue is the cached writing queue shared by connS and clientS.
+type writeQueue struct {
+	ch        chan *writeReq
+	policy    WriteQueuePolicy
+	done      chan struct{}
+	closeOnce sync.Once
+	dropped   int64
+}
+
+func newWriteQueue(size int, policy WriteQueuePolicy) *writeQueue {
+	if size <= 0 {
+		size = defaultWriteQueueSize
+	}
+	return &writeQueue{
+		ch:     make(chan *writeReq, size),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+}
+
+// push puts req into the queue according to the policy. If push
+// fails, req has been resolved with the returned error.
+//
+// errDisconnect is true if the caller should close the connection
+// because of WriteQueueDisconnect policy.
+func (q *writeQueue) push(ctx context.Context, req *writeReq) (errDisconnect bool, err error) {
+	defer func() {
+		if err != nil {
+			req.resolve(0, err)
+		}
+	}()
+
+	select {
+	case <-q.done:
+		return false, net.ErrClosed
+	default:
+	}
+
+	select {
+	case q.ch <- req:
+		q.discardIfClosed()
+		return
+	default:
+	}
+
+	switch q.policy {
+	case WriteQueueDropNewest:
+		atomic.AddInt64(&q.dropped, 1)
+		err = api.ErrWriteQueueFull
+
+	case WriteQueueDropOldest:
+		for {
+			select {
+			case q.ch <- req:
+				q.discardIfClosed()
+				return
+			default:
+			}
+			select {
+			case old := <-q.ch:
+				atomic.AddInt64(&q.dropped, 1)
+				old.resolve(0, api.ErrWriteQueueFull)
+			default:
+			}
+		}
+
+	case WriteQueueDisconnect:
+		atomic.AddInt64(&q.dropped, 1)
+		errDisconnect, err = true, api.ErrWriteQueueFull
+
+	default: // WriteQueueBlock
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		select {
+		case q.ch <- req:
+			q.discardIfClosed()
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-q.done:
+			err = net.ErrClosed
+		}
+	}
+	return
+}
+
+// discardIfClosed settles the requests which were pushed while the
+// queue was being closed, since nobody will write them anymore.
+func (q *writeQueue) discardIfClosed() {
+	select {
+	case <-q.done:
+		q.discard(net.ErrClosed)
+	default:
+	}
+}
+
+// discard resolves all queued requests with err.
+func (q *writeQueue) discard(err error) {
+	for {
+		select {
+		case req := <-q.ch:
+			req.resolve(0, err)
+		default:
+			return
+		}
+	}
+}
+
+// takeAll removes and returns the queued requests without settling
+// them.
+func (q *writeQueue) takeAll() (reqs []*writeReq) {
+	for {
+		select {
+		case req := <-q.ch:
+			reqs = append(reqs, req)
+		default:
+			return
+		}
+	}
+}
+
+// drain collects first and the messages queued behind it, up to
+// limit messages. If delay is positive, it waits up to delay for more
+// messages while the batch is not full, as an application-level
+// Nagle algorithm.
+func (q *writeQueue) drain(first *writeReq, limit int, delay time.Duration) (batch []*writeReq) {
+	if limit <= 0 {
+		limit = defaultWriteBatchSize
+	}
+	batch = append(make([]*writeReq, 0, min(limit, q.Cap()+1)), first)
+
+	var timer <-chan time.Time
+	for len(batch) < limit {
+		select {
+		case req := <-q.ch:
+			batch = append(batch, req)
+			continue
+		default:
+		}
+
+		if delay <= 0 {
+			break
+		}
+		if timer == nil {
+			t := time.NewTimer(delay)
+			defer t.Stop()
+			timer = t.C
+		}
+		select {
+		case req := <-q.ch:
+			batch = append(batch, req)
+			continue
+		case <-timer:
+		case <-q.done:
+		}
+		break
+	}
+	return
+}
+
+// close wakes up the blocked producers. The channel itself is kept
+// open so that a late producer never panics.
+func (q *writeQueue) close() {
+	q.closeOnce.Do(func() { close(q.done) })
+}
+
+func (q *writeQueue) Len() int       { return len(q.ch) }
+func (q *writeQueue) Cap() int       { return cap(q.ch) }
+func (q *writeQueue) Dropped() int64 { return atomic.LoadInt64(&q.dropped) }
+
+// writeBatch runs the OnWriting interceptor on each message of batch,
+// and sends the rest of them with one vectored write (writev) per run
+// of messages between the barriers, so that nothing after a barrier
+// is sent before it is resolved. Every request in batch is resolved
+// after writeBatch returned.
+//
+// The messages rejected with api.ErrWriteClosed by write are failed,
+// but the connection is kept, so a nil error is returned for them.
+func writeBatch(ctx context.Context, pi api.Interceptor, conn api.Conn, batch []*writeReq,
+	write func(bufs net.Buffers) (n int64, err error)) (err error) {
+	for len(batch) > 0 {
+		i := 0
+		for i < len(batch) && len(batch[i].data) > 0 {
+			i++
+		}
+		if i < len(batch) {
+			i++ // the barrier ends the run
+		}
+		if err = writeRun(ctx, pi, conn, batch[:i], write); err != nil && !errors.Is(err, api.ErrWriteClosed) {
+			for _, r := range batch[i:] {
+				r.resolve(0, err)
+			}
+			return
+		}
+		batch = batch[i:]
+	}
+	return nil
+}
+
+// writeRun writes a run of messages ended by a barrier at most.
+func writeRun(ctx context.Context, pi api.Interceptor, conn api.Conn, batch []*writeReq,
+	write func(bufs net.Buffers) (n int64, err error)) (err error) {
+	bufs := make(net.Buffers, 0, len(batch))
+	pending := make([]*writeReq, 0, len(batch))
+	for i, req := range batch {
+		if len(req.data) == 0 {
+			pending = append(pending, req) // a barrier, resolved after the bytes before it written
+			continue
+		}
+		if pi != nil {
+			var processed bool
+			if processed, err = pi.OnWriting(ctx, conn, req.data); processed {
+				req.resolve(len(req.data), err)
+				err = nil
+				continue
+			} else if err != nil {
+				_ = flushRun(bufs, pending, write) // the messages before it are fine
+				for _, r := range batch[i:] {
+					r.resolve(0, err)
+				}
+				return
+			}
+		}
+		bufs = append(bufs, req.data)
+		pending = append(pending, req)
+	}
+	return flushRun(bufs, pending, write)
+}
+
+// flushRun writes bufs, and resolves the pending requests, including
+// the barriers, by the result.
+func flushRun(bufs net.Buffers, pending []*writeReq, write func(bufs net.Buffers) (n int64, err error)) (err error) {
+	var written int64
+	if len(bufs) > 0 {
+		written, err = write(bufs)
+	}
+	for _, req := range pending {
+		n := int(min(written, int64(len(req.data))))
+		written -= int64(n)
+		if n == len(req.data) && (n > 0 || err == nil) {
+			req.resolve(n, nil)
+		} else if err != nil {
+			req.resolve(n, err)
+		} else {
+			req.resolve(n, io.ErrShortWrite)
+		}
+	}
+	return
+}
+
+// writeContext writes data to *pconn directly. The earlier one of ctx
+// deadline and timeout is applied, and a cancellation of ctx
+// interrupts a blocked writing.
+func writeContext(ctx context.Context, pconn *connRef, wl sync.Locker, data []byte, timeout time.Duration) (n int, err error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	wl.Lock()
+	defer wl.Unlock()
+	conn := pconn.Load() // taken under wl, see StartTLS
+	if conn == nil {
+		return 0, net.ErrClosed
+	}
+	if err = conn.SetWriteDeadline(deadline); err != nil {
+		return
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetWriteDeadline(aLongTimeAgo) })
+	n, err = conn.Write(data)
+	if !stop() && err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used for
+// immediate cancellation of blocked I/O.
+var aLongTimeAgo = time.Unix(1, 0)
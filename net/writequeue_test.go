@@ -0,0 +1,189 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hedzr/go-socketlib/net/api"
+)
+
+func TestWriteQueue_policies(t *testing.T) {
+	for _, c := range []struct {
+		policy     WriteQueuePolicy
+		err        error
+		disconnect bool
+		first      string // the head of queue after pushing
+	}{
+		{WriteQueueDropNewest, api.ErrWriteQueueFull, false, "1"},
+		{WriteQueueDropOldest, nil, false, "2"},
+		{WriteQueueDisconnect, api.ErrWriteQueueFull, true, "1"},
+	} {
+		q := newWriteQueue(2, c.policy)
+		for _, m := range []string{"1", "2"} {
+			if _, err := q.push(context.Background(), newWriteReq([]byte(m), false, nil)); err != nil {
+				t.Fatalf("%v: push %q failed: %v", c.policy, m, err)
+			}
+		}
+		disconnect, err := q.push(context.Background(), newWriteReq([]byte("3"), false, nil))
+		if !errors.Is(err, c.err) || disconnect != c.disconnect {
+			t.Fatalf("%v: expect (%v, %v), but got (%v, %v)", c.policy, c.disconnect, c.err, disconnect, err)
+		}
+		if q.Len() != 2 || q.Dropped() != 1 {
+			t.Fatalf("%v: expect len 2 and 1 dropped, but got len %d and %d dropped", c.policy, q.Len(), q.Dropped())
+		}
+		if head := string((<-q.ch).data); head != c.first {
+			t.Fatalf("%v: expect queue head %q, but got %q", c.policy, c.first, head)
+		}
+	}
+}
+
+func TestWriteQueue_block(t *testing.T) {
+	q := newWriteQueue(1, WriteQueueBlock)
+	if _, err := q.push(context.Background(), newWriteReq([]byte("1"), false, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.push(ctx, newWriteReq([]byte("2"), false, nil)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, but got %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		q.close()
+	}()
+	if _, err := q.push(context.Background(), newWriteReq([]byte("3"), false, nil)); err == nil {
+		t.Fatal("expect an error after queue closed")
+	}
+}
+
+func TestWriteQueue_drain(t *testing.T) {
+	q := newWriteQueue(8, WriteQueueBlock)
+	for _, m := range []string{"2", "3", "4"} {
+		_, _ = q.push(context.Background(), newWriteReq([]byte(m), false, nil))
+	}
+	if batch := q.drain(newWriteReq([]byte("1"), false, nil), 3, 0); len(batch) != 3 || string(batch[2].data) != "3" {
+		t.Fatalf("expect 3 messages drained, but got %d", len(batch))
+	}
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		_, _ = q.push(context.Background(), newWriteReq([]byte("5"), false, nil))
+	}()
+	if batch := q.drain(<-q.ch, 0, 50*time.Millisecond); len(batch) != 2 || string(batch[1].data) != "5" {
+		t.Fatalf("expect the delayed message coalesced, but got %d messages", len(batch))
+	}
+}
+
+func TestWriteQueue_completion(t *testing.T) {
+	q := newWriteQueue(1, WriteQueueDropOldest)
+	oldest := newWriteReq([]byte("1"), true, nil)
+	_, _ = q.push(context.Background(), oldest)
+	_, _ = q.push(context.Background(), newWriteReq([]byte("2"), false, nil))
+	if _, err := oldest.Wait(context.Background()); !errors.Is(err, api.ErrWriteQueueFull) {
+		t.Fatalf("expect the dropped message resolved with ErrWriteQueueFull, but got %v", err)
+	}
+
+	var got []int
+	batch := []*writeReq{
+		newWriteReq([]byte("abc"), false, func(n int, err error) { got = append(got, n) }),
+		newWriteReq([]byte("defg"), false, func(n int, err error) { got = append(got, n) }),
+	}
+	errShort := errors.New("short")
+	err := writeBatch(context.Background(), nil, nil, batch, func(bufs net.Buffers) (n int64, err error) {
+		return 5, errShort
+	})
+	if !errors.Is(err, errShort) || len(got) != 2 || got[0] != 3 || got[1] != 2 {
+		t.Fatalf("expect partial writing resolved as [3 2], but got %v (err: %v)", got, err)
+	}
+	if _, err = batch[1].Result(); !errors.Is(err, errShort) {
+		t.Fatalf("expect the partial message failed, but got %v", err)
+	}
+
+	q = newWriteQueue(1, WriteQueueBlock)
+	pending := newWriteReq([]byte("3"), true, nil)
+	_, _ = q.push(context.Background(), pending)
+	q.close()
+	q.discard(net.ErrClosed)
+	if _, err = pending.Wait(context.Background()); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expect the pending message failed with ErrClosed, but got %v", err)
+	}
+}
+
+func TestWriteBatch_barrier(t *testing.T) {
+	var sealed bool
+	var writes [][]string
+	batch := []*writeReq{
+		newWriteReq([]byte("a"), true, nil),
+		newWriteReq(nil, true, func(int, error) { sealed = true }),
+		newWriteReq([]byte("b"), true, nil),
+	}
+	err := writeBatch(context.Background(), nil, nil, batch, func(bufs net.Buffers) (n int64, err error) {
+		var w []string
+		for _, b := range bufs {
+			w = append(w, string(b))
+		}
+		writes = append(writes, w)
+		if sealed {
+			return 0, api.ErrWriteClosed
+		}
+		return int64(len(bufs[0])), nil
+	})
+	if err != nil {
+		t.Fatalf("expect the rejected messages not to fail the batch, but got %v", err)
+	}
+	if len(writes) != 2 || len(writes[0]) != 1 || writes[0][0] != "a" {
+		t.Fatalf("expect the batch split at the barrier, but got %v", writes)
+	}
+	if _, err = batch[0].Result(); err != nil {
+		t.Fatalf("expect the message before the barrier written, but got %v", err)
+	}
+	if _, err = batch[2].Result(); !errors.Is(err, api.ErrWriteClosed) {
+		t.Fatalf("expect the message after the barrier rejected, but got %v", err)
+	}
+}
+
+// failingWriter fails the writing of "bad".
+type failingWriter struct{ holdWriter }
+
+var errBadMessage = errors.New("bad message")
+
+func (f *failingWriter) OnWriting(ctx context.Context, conn api.Conn, data []byte) (processed bool, err error) {
+	if string(data) == "bad" {
+		err = errBadMessage
+	}
+	return
+}
+
+func TestWriteBatch_interceptorFailed(t *testing.T) {
+	var written string
+	batch := []*writeReq{
+		newWriteReq([]byte("a"), true, nil),
+		newWriteReq([]byte("b"), true, nil),
+		newWriteReq([]byte("bad"), true, nil),
+		newWriteReq([]byte("c"), true, nil),
+	}
+	err := writeBatch(context.Background(), &failingWriter{}, nil, batch, func(bufs net.Buffers) (n int64, err error) {
+		for _, b := range bufs {
+			written += string(b)
+			n += int64(len(b))
+		}
+		return
+	})
+	if !errors.Is(err, errBadMessage) {
+		t.Fatalf("expect the error of the interceptor, but got %v", err)
+	}
+	if written != "ab" {
+		t.Fatalf("expect the messages before the bad one written, but got %q", written)
+	}
+	for i, req := range batch {
+		n, err := req.Result()
+		if i < 2 && (n != 1 || err != nil) || i >= 2 && !errors.Is(err, errBadMessage) {
+			t.Fatalf("unexpected result of message %d: %d, %v", i, n, err)
+		}
+	}
+}